@@ -0,0 +1,435 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetExpiration = 24 * time.Hour
+
+// AdminUser is the view of a user shown to admins, including the account
+// state hidden from other users.
+type AdminUser struct {
+	User
+	Is_Suspended        bool       `json:"is_suspended"`
+	Suspension          string     `json:"suspension,omitempty"`
+	Must_Reset_Password bool       `json:"must_reset_password"`
+	Tokens_Revoked_At   *time.Time `json:"tokens_revoked_at,omitempty"`
+	Sessions            int        `json:"sessions"`
+}
+
+type PasswordResetToken struct {
+	User_Id    int       `json:"user_id"`
+	Token      string    `json:"token"`
+	Expires_At time.Time `json:"expires_at"`
+}
+
+// loadAdminUsers returns the admin view of users, counting each user's
+// unexpired refresh tokens as their sessions.
+func loadAdminUsers(db *database.DB, users []database.User) ([]AdminUser, error) {
+	tokens, err := db.GetRefreshTokens()
+
+	if err != nil {
+		return nil, err
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	sessions := map[int]int{}
+
+	for _, token := range tokens {
+		if token.UserId != 0 && token.Expiration >= today {
+			sessions[token.UserId]++
+		}
+	}
+
+	adminUsers := make([]AdminUser, 0, len(users))
+
+	for _, user := range users {
+		adminUser := AdminUser{
+			User:                userFromDB(user),
+			Is_Suspended:        user.Is_Suspended,
+			Suspension:          user.Suspension,
+			Must_Reset_Password: user.Must_Reset_Password,
+			Sessions:            sessions[user.Id],
+		}
+
+		if !user.Tokens_Revoked_At.IsZero() {
+			revokedAt := user.Tokens_Revoked_At
+			adminUser.Tokens_Revoked_At = &revokedAt
+		}
+
+		adminUsers = append(adminUsers, adminUser)
+	}
+
+	return adminUsers, nil
+}
+
+// findUsers returns the users whose email or handle contains q, or every
+// user when q is empty, ordered by id.
+func findUsers(db *database.DB, q string) ([]database.User, error) {
+	if q != "" {
+		return db.SearchUsers(q)
+	}
+
+	users, err := db.GetUsers()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+
+	return users, nil
+}
+
+func validateRole(role string) error {
+	if _, ok := roleRanks[role]; !ok {
+		return errors.New("role must be one of user, moderator, admin")
+	}
+
+	return nil
+}
+
+// createPasswordReset issues a reset token for the user. Only its hash is
+// stored, so the token is returned to be handed to the user.
+func createPasswordReset(db *database.DB, userId int) (PasswordResetToken, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+
+	if err != nil {
+		return PasswordResetToken{}, err
+	}
+
+	token := hex.EncodeToString(randomBytes)
+	expiresAt := time.Now().UTC().Add(passwordResetExpiration)
+
+	err = db.RequirePasswordReset(userId, hashResetToken(token), expiresAt)
+
+	if err != nil {
+		return PasswordResetToken{}, err
+	}
+
+	return PasswordResetToken{User_Id: userId, Token: token, Expires_At: expiresAt}, nil
+}
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (cfg *apiConfig) handlerAdminGetUsers(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePageRequest(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbUsers, err := findUsers(cfg.DB, strings.TrimSpace(r.URL.Query().Get("q")))
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retreive users")
+		return
+	}
+
+	if role := r.URL.Query().Get("role"); role != "" {
+		filtered := []database.User{}
+
+		for _, user := range dbUsers {
+			if userRole(user) == role {
+				filtered = append(filtered, user)
+			}
+		}
+
+		dbUsers = filtered
+	}
+
+	users, err := loadAdminUsers(cfg.DB, dbUsers)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retreive users")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, paginateRanked(w, r, users, page))
+}
+
+func (cfg *apiConfig) handlerAdminGetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := cfg.loadTargetUser(w, r)
+
+	if !ok {
+		return
+	}
+
+	cfg.respondWithAdminUser(w, user.Id)
+}
+
+func (cfg *apiConfig) handlerAdminSetRole(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+
+	user, ok := cfg.loadTargetUser(w, r)
+
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	err = validateRole(params.Role)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !cfg.checkNotSelf(w, r, user.Id) {
+		return
+	}
+
+	err = cfg.DB.SetUserRole(user.Id, params.Role)
+	cfg.audit(r, cfg.callerId(r), "admin.set_role."+params.Role, auditTarget("user", user.Id), auditOutcome(err))
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not update user")
+		return
+	}
+
+	cfg.respondWithAdminUser(w, user.Id)
+}
+
+// handlerAdminGrantChirpyRed grants a plan, by default Chirpy Red for one
+// billing period. The body is optional.
+func (cfg *apiConfig) handlerAdminGrantChirpyRed(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Plan               string     `json:"plan"`
+		Current_Period_End *time.Time `json:"current_period_end"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	if _, ok := cfg.Entitlements.Plans()[params.Plan]; params.Plan != "" && !ok {
+		respondWithError(w, http.StatusBadRequest, "Unknown plan")
+		return
+	}
+
+	if params.Current_Period_End != nil && !params.Current_Period_End.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "current_period_end must be in the future")
+		return
+	}
+
+	cfg.updateTargetUser(w, r, "admin.grant_chirpy_red", func(id int) error {
+		return grantChirpyRed(cfg.DB, id, params.Plan, params.Current_Period_End)
+	})
+}
+
+func (cfg *apiConfig) handlerAdminRevokeChirpyRed(w http.ResponseWriter, r *http.Request) {
+	cfg.updateTargetUser(w, r, "admin.revoke_chirpy_red", func(id int) error {
+		return revokeChirpyRed(cfg.DB, id)
+	})
+}
+
+func (cfg *apiConfig) handlerAdminSuspendUser(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Reason string `json:"reason"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	cfg.updateTargetUser(w, r, "admin.suspend", func(id int) error {
+		return cfg.DB.SuspendUser(id, strings.TrimSpace(params.Reason))
+	})
+}
+
+func (cfg *apiConfig) handlerAdminUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateTargetUser(w, r, "admin.unsuspend", cfg.DB.UnsuspendUser)
+}
+
+func (cfg *apiConfig) handlerAdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	cfg.updateTargetUser(w, r, "admin.revoke_sessions", cfg.DB.RevokeSessions)
+}
+
+func (cfg *apiConfig) handlerAdminResetPassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := cfg.loadTargetUser(w, r)
+
+	if !ok {
+		return
+	}
+
+	if !cfg.checkNotSelf(w, r, user.Id) {
+		return
+	}
+
+	reset, err := createPasswordReset(cfg.DB, user.Id)
+	cfg.audit(r, cfg.callerId(r), "admin.password_reset", auditTarget("user", user.Id), auditOutcome(err))
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not create password reset")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, reset)
+}
+
+// handlerPasswordReset lets a user set a new password with the token an
+// admin gave them.
+func (cfg *apiConfig) handlerPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	if params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Password is required")
+		return
+	}
+
+	hashPassword, err := bcrypt.GenerateFromPassword([]byte(params.Password), 7)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not hash Password")
+		return
+	}
+
+	user, err := cfg.DB.ResetPassword(hashResetToken(params.Token), hashPassword)
+	cfg.audit(r, user.Id, "user.password_reset", auditTarget("user", user.Id), auditOutcome(err))
+
+	if errors.Is(err, database.ErrResetTokenInvalid) {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not reset password")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, userFromDB(user))
+}
+
+// updateTargetUser applies update to the user in the path, refusing to let
+// admins change their own account, and responds with the updated user.
+func (cfg *apiConfig) updateTargetUser(w http.ResponseWriter, r *http.Request, action string, update func(id int) error) {
+	user, ok := cfg.loadTargetUser(w, r)
+
+	if !ok {
+		return
+	}
+
+	if !cfg.checkNotSelf(w, r, user.Id) {
+		return
+	}
+
+	err := update(user.Id)
+	cfg.audit(r, cfg.callerId(r), action, auditTarget("user", user.Id), auditOutcome(err))
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not update user")
+		return
+	}
+
+	cfg.respondWithAdminUser(w, user.Id)
+}
+
+func (cfg *apiConfig) loadTargetUser(w http.ResponseWriter, r *http.Request) (database.User, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return database.User{}, false
+	}
+
+	user, err := cfg.DB.GetUser(id)
+
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return database.User{}, false
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retreive users")
+		return database.User{}, false
+	}
+
+	return user, true
+}
+
+func (cfg *apiConfig) checkNotSelf(w http.ResponseWriter, r *http.Request, targetId int) bool {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return false
+	}
+
+	if userId == targetId {
+		respondWithError(w, http.StatusBadRequest, "Cannot target yourself")
+		return false
+	}
+
+	return true
+}
+
+func (cfg *apiConfig) respondWithAdminUser(w http.ResponseWriter, id int) {
+	user, err := cfg.DB.GetUser(id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retreive users")
+		return
+	}
+
+	users, err := loadAdminUsers(cfg.DB, []database.User{user})
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retreive users")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, users[0])
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+	auditDenied  = "denied"
+)
+
+// audit records a security-sensitive event. r is nil for events raised by
+// background jobs rather than requests. Failing to write the audit log is
+// logged but does not fail the request.
+func (cfg *apiConfig) audit(r *http.Request, actorId int, action, target, outcome string) {
+	entry := database.AuditEntry{
+		Actor_Id: actorId,
+		Action:   action,
+		Target:   target,
+		Outcome:  outcome,
+	}
+
+	if r != nil {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		entry.Ip = ip
+		entry.User_Agent = r.UserAgent()
+	}
+
+	_, err := cfg.Audit.Append(entry)
+
+	if err != nil {
+		log.Printf("Could not write audit entry %s: %s", action, err)
+	}
+}
+
+func auditTarget(kind string, id int) string {
+	return fmt.Sprintf("%s:%d", kind, id)
+}
+
+func auditOutcome(err error) string {
+	if err != nil {
+		return auditFailure
+	}
+
+	return auditSuccess
+}
+
+// handlerGetAudit lists audit entries oldest first. It accepts actor_id,
+// action, target and outcome filters and since/until times in RFC 3339
+// form.
+func (cfg *apiConfig) handlerGetAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.AuditFilter{
+		Action:  query.Get("action"),
+		Target:  query.Get("target"),
+		Outcome: query.Get("outcome"),
+	}
+
+	if actorString := query.Get("actor_id"); actorString != "" {
+		actorId, err := strconv.Atoi(actorString)
+
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Could not parse actor_id")
+			return
+		}
+
+		filter.Actor_Id = &actorId
+	}
+
+	for _, bound := range []struct {
+		name  string
+		value *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		value := query.Get(bound.name)
+
+		if value == "" {
+			continue
+		}
+
+		parsed, err := time.Parse(time.RFC3339, value)
+
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s time, expected RFC 3339", bound.name))
+			return
+		}
+
+		*bound.value = parsed
+	}
+
+	page, err := parsePageRequest(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := cfg.Audit.Entries(filter)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not read audit log")
+		return
+	}
+
+	entries, next, prev := paginate(entries, page, func(entry database.AuditEntry) cursor {
+		return cursor{Id: entry.Id}
+	}, cursorPrecedes)
+	setPageLinks(w, r, page, next, prev)
+
+	respondWithJSON(w, http.StatusOK, entries)
+}
+
+func (cfg *apiConfig) handlerExportAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	w.WriteHeader(http.StatusOK)
+
+	err := cfg.Audit.Export(w)
+
+	if err != nil {
+		log.Printf("Could not export audit log: %s", err)
+	}
+}
+
+func (cfg *apiConfig) handlerVerifyAudit(w http.ResponseWriter, r *http.Request) {
+	type verification struct {
+		Valid   bool   `json:"valid"`
+		Entries int    `json:"entries"`
+		Error   string `json:"error,omitempty"`
+	}
+
+	count, err := cfg.Audit.Verify()
+
+	if err != nil {
+		respondWithJSON(w, http.StatusOK, verification{Valid: false, Entries: count, Error: err.Error()})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, verification{Valid: true, Entries: count})
+}
+
+// callerId returns the id of the authenticated caller, or 0 for handlers
+// whose authentication was already checked by requireRole.
+func (cfg *apiConfig) callerId(r *http.Request) int {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		return 0
+	}
+
+	return userId
+}
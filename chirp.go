@@ -3,39 +3,142 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/unicode/norm"
 )
 
 type Chirp struct {
-	Id        int    `json:"id"`
-	Body      string `json:"body"`
-	Author_Id int    `json:"author_id"`
+	Id            int               `json:"id"`
+	Body          string            `json:"body"`
+	Author_Id     int               `json:"author_id"`
+	In_Reply_To   int               `json:"in_reply_to,omitempty"`
+	Quote_Of      int               `json:"quote_of,omitempty"`
+	Quoted        *QuotedChirp      `json:"quoted,omitempty"`
+	Entities      []database.Entity `json:"entities"`
+	Reply_Count   int               `json:"reply_count"`
+	Like_Count    int               `json:"like_count"`
+	Rechirp_Count int               `json:"rechirp_count"`
+	Quote_Count   int               `json:"quote_count"`
+	Created_At    time.Time         `json:"created_at"`
+	Updated_At    time.Time         `json:"updated_at"`
 }
 
-func (cfg *apiConfig) handlerChirpReceive(w http.ResponseWriter, r *http.Request) {
-	type inputs struct {
-		Body string `json:"body"`
+// QuotedChirp is the compact rendering of a quoted chirp embedded in the
+// quoting chirp. When the original is deleted or hidden from the caller only
+// the id and Tombstone are set.
+type QuotedChirp struct {
+	Id         int        `json:"id"`
+	Body       string     `json:"body,omitempty"`
+	Author_Id  int        `json:"author_id,omitempty"`
+	Created_At *time.Time `json:"created_at,omitempty"`
+	Tombstone  bool       `json:"tombstone,omitempty"`
+}
+
+func chirpFromDB(chirp database.Chirp, counts database.ChirpCounts) Chirp {
+	return Chirp{
+		Id:            chirp.Id,
+		Body:          chirp.Body,
+		Author_Id:     chirp.Author_Id,
+		In_Reply_To:   chirp.In_Reply_To,
+		Quote_Of:      chirp.Quote_Of,
+		Entities:      chirp.Entities,
+		Reply_Count:   counts.Replies,
+		Like_Count:    counts.Likes,
+		Rechirp_Count: counts.Rechirps,
+		Quote_Count:   counts.Quotes,
+		Created_At:    chirp.Created_At,
+		Updated_At:    chirp.Updated_At,
 	}
+}
+
+func (cfg *apiConfig) renderChirps(caller viewer, dbChirps []database.Chirp) ([]Chirp, error) {
+	counts, err := cfg.DB.GetChirpCounts()
 
-	authHeader := r.Header.Get("Authorization")
+	if err != nil {
+		return nil, err
+	}
 
-	splitHeader := strings.Split(authHeader, " ")
+	quotedIds := []int{}
 
-	token := splitHeader[1]
+	for _, dbChirp := range dbChirps {
+		if dbChirp.Quote_Of != 0 {
+			quotedIds = append(quotedIds, dbChirp.Quote_Of)
+		}
+	}
 
-	userIdString, err := cfg.validateToken(token)
+	quoted, err := cfg.DB.GetChirpsById(quotedIds)
 
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return nil, err
 	}
 
-	author_id, err := strconv.Atoi(userIdString)
+	chirps := make([]Chirp, 0, len(dbChirps))
+
+	for _, dbChirp := range dbChirps {
+		chirp := chirpFromDB(dbChirp, counts[dbChirp.Id])
+
+		if chirp.Entities == nil {
+			chirp.Entities = []database.Entity{}
+		}
+
+		if dbChirp.Quote_Of != 0 {
+			chirp.Quoted = &QuotedChirp{Id: dbChirp.Quote_Of, Tombstone: true}
+
+			original, ok := quoted[dbChirp.Quote_Of]
+
+			if ok && caller.canSee(original.Author_Id) {
+				chirp.Quoted = &QuotedChirp{
+					Id:         original.Id,
+					Body:       original.Body,
+					Author_Id:  original.Author_Id,
+					Created_At: &original.Created_At,
+				}
+			}
+		}
+
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, nil
+}
+
+func (cfg *apiConfig) renderChirp(caller viewer, dbChirp database.Chirp) (Chirp, error) {
+	chirps, err := cfg.renderChirps(caller, []database.Chirp{dbChirp})
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return Chirp{}, err
+	}
+
+	return chirps[0], nil
+}
+
+func (cfg *apiConfig) handlerChirpReceive(w http.ResponseWriter, r *http.Request) {
+	type inputs struct {
+		Body        string `json:"body"`
+		In_Reply_To int    `json:"in_reply_to"`
+		Quote_Of    int    `json:"quote_of"`
+	}
+
+	author_id, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if !cfg.requireActive(w, author_id) {
+		return
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -48,72 +151,154 @@ func (cfg *apiConfig) handlerChirpReceive(w http.ResponseWriter, r *http.Request
 
 	}
 
-	cleaned, err := validateChirp(input.Body)
+	_, entitlements, err := cfg.entitlementsFor(author_id)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	cleaned, flagged, err := cfg.filterChirp(input.Body, entitlements.Max_Chirp_Length)
 
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	chirp, err := cfg.DB.CreateChirp(cleaned, author_id)
+	if !cfg.checkReferencedChirp(w, author_id, input.In_Reply_To, "Chirp being replied to does not exist", "Cannot reply to this Chirp") {
+		return
+	}
+
+	if !cfg.checkReferencedChirp(w, author_id, input.Quote_Of, "Chirp being quoted does not exist", "Cannot quote this Chirp") {
+		return
+	}
+
+	if !cfg.allowChirp(w, author_id, entitlements) {
+		return
+	}
+
+	entities, err := cfg.resolveMentions(parseEntities(cleaned))
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not Create Chirp")
+		respondWithError(w, http.StatusInternalServerError, "Could not resolve mentions")
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, chirp)
-}
+	dbChirp, err := cfg.DB.CreateChirp(database.Chirp{
+		Body:        cleaned,
+		Author_Id:   author_id,
+		In_Reply_To: input.In_Reply_To,
+		Quote_Of:    input.Quote_Of,
+		Entities:    entities,
+	})
 
-func (cfg *apiConfig) handlerGetChirp(w http.ResponseWriter, r *http.Request) {
-	dbChirps, err := cfg.DB.GetChirps()
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusBadRequest, "Referenced Chirp does not exist")
+		return
+	}
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		respondWithError(w, http.StatusInternalServerError, "Could not Create Chirp")
+		return
 	}
 
-	path := r.PathValue("id")
+	cfg.Trends.Record(dbChirp)
+	cfg.emitEvent("chirp.created", []int{dbChirp.Author_Id}, dbChirp)
+	cfg.federateChirp("chirp.created", dbChirp)
 
-	id, err := strconv.Atoi(path)
+	if len(flagged) > 0 {
+		cfg.reportFlaggedChirp(dbChirp, flagged)
+	}
+
+	err = cfg.notifyReferences(dbChirp)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not parse Id")
+		log.Printf("Could not notify replied to or quoted author: %s", err)
 	}
 
-	for _, chirp := range dbChirps {
-		if chirp.Id == id {
-			respondWithJSON(w, http.StatusOK, chirp)
-			return
-		}
+	err = cfg.notifyMentions(dbChirp, nil)
+
+	if err != nil {
+		log.Printf("Could not notify mentions: %s", err)
+	}
+
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
 	}
 
-	respondWithError(w, http.StatusNotFound, "Could not find Id")
+	chirp, err := cfg.renderChirp(caller, dbChirp)
 
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, chirp)
 }
 
-func (cfg *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
+// checkReferencedChirp verifies that a chirp being replied to or quoted
+// exists and that neither author has blocked the other, writing the error
+// response itself when it does not. A zero id is not a reference.
+func (cfg *apiConfig) checkReferencedChirp(w http.ResponseWriter, authorId, chirpId int, missingMsg, blockedMsg string) bool {
+	if chirpId == 0 {
+		return true
+	}
 
-	authHeader := r.Header.Get("Authorization")
+	referenced, err := cfg.DB.GetChirp(chirpId)
 
-	splitHeader := strings.Split(authHeader, " ")
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusBadRequest, missingMsg)
+		return false
+	}
 
-	token := splitHeader[1]
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirp")
+		return false
+	}
 
-	userIdString, err := cfg.validateToken(token)
+	blocked, err := cfg.DB.IsBlocked(authorId, referenced.Author_Id)
 
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve relationships")
+		return false
+	}
+
+	if blocked {
+		respondWithError(w, http.StatusForbidden, blockedMsg)
+		return false
+	}
+
+	return true
+}
+
+func (cfg *apiConfig) handlerGetChirp(w http.ResponseWriter, r *http.Request) {
+	caller, chirp, ok := cfg.loadVisibleChirp(w, r)
+
+	if !ok {
+		return
 	}
 
-	author_id, err := strconv.Atoi(userIdString)
+	rendered, err := cfg.renderChirp(caller, chirp)
+
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not parse Author")
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirp")
+		return
 	}
 
-	dbChirps, err := cfg.DB.GetChirps()
+	respondWithJSON(w, http.StatusOK, rendered)
+
+}
+
+func (cfg *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request) {
+
+	author_id, err := cfg.authenticate(r)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
 	}
 
 	path := r.PathValue("id")
@@ -121,99 +306,419 @@ func (cfg *apiConfig) handlerDeleteChirp(w http.ResponseWriter, r *http.Request)
 	id, err := strconv.Atoi(path)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not parse Id")
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return
 	}
 
-	for _, chirp := range dbChirps {
-		if chirp.Id == id {
-			if chirp.Author_Id != author_id {
-				respondWithError(w, http.StatusForbidden, "User does not own Chirp, did not delete")
-			}
+	chirp, err := cfg.DB.GetChirp(id)
 
-			err := cfg.DB.DeleteChirp(id)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
 
-			if err != nil {
-				respondWithError(w, http.StatusInternalServerError, "Deletion Failed")
-			}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirp")
+		return
+	}
 
-		}
+	if chirp.Author_Id != author_id {
+		cfg.audit(r, author_id, "chirp.delete", auditTarget("chirp", id), auditDenied)
+		respondWithError(w, http.StatusForbidden, "User does not own Chirp, did not delete")
+		return
+	}
+
+	err = cfg.DB.DeleteChirp(id)
+	cfg.audit(r, author_id, "chirp.delete", auditTarget("chirp", id), auditOutcome(err))
+
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Deletion Failed")
+		return
 	}
 
+	cfg.Trends.Remove(id)
+	cfg.emitChirpDeleted(chirp)
+	cfg.federateChirp("chirp.deleted", chirp)
+
 	respondWithJSON(w, http.StatusNoContent, "")
 
 }
-func (cfg *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
-
-	authorIdString := r.URL.Query().Get("author_id")
-	sortDirection := r.URL.Query().Get("sort")
 
+// queryChirps returns the chirps by the author with authorIdString that the
+// caller can see, or when it is empty every chirp the caller wants in their
+// timeline.
+func (cfg *apiConfig) queryChirps(caller viewer, authorIdString string) ([]database.Chirp, error) {
 	dbChirps, err := cfg.DB.GetChirps()
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return nil, err
 	}
 
-	chirps := []Chirp{}
+	visible := []database.Chirp{}
 
 	if authorIdString == "" {
 		for _, chirp := range dbChirps {
-			chirps = append(chirps, Chirp{
-				Id:        chirp.Id,
-				Body:      chirp.Body,
-				Author_Id: chirp.Author_Id,
-			})
+			if !caller.wantsInTimeline(chirp.Author_Id) {
+				continue
+			}
+			visible = append(visible, chirp)
 		}
 	} else {
 		for _, chirp := range dbChirps {
-			if strconv.Itoa(chirp.Author_Id) == authorIdString {
-				chirps = append(chirps, Chirp{
-					Id:        chirp.Id,
-					Body:      chirp.Body,
-					Author_Id: chirp.Author_Id,
-				})
-
+			if strconv.Itoa(chirp.Author_Id) == authorIdString && caller.canSee(chirp.Author_Id) {
+				visible = append(visible, chirp)
 			}
 		}
 	}
 
-	if sortDirection == "asc" || sortDirection == "" {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].Id < chirps[j].Id
-		})
-	} else {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].Id > chirps[j].Id
-		})
+	return visible, nil
+}
+
+func (cfg *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
+
+	authorIdString := r.URL.Query().Get("author_id")
+	sortDirection := r.URL.Query().Get("sort")
+
+	page, err := parsePageRequest(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	visible, err := cfg.queryChirps(caller, authorIdString)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
+	}
+
+	precedes := cursorPrecedes
+
+	if sortDirection == "desc" {
+		precedes = func(a, b cursor) bool {
+			return cursorPrecedes(b, a)
+		}
+	}
+
+	sort.Slice(visible, func(i, j int) bool {
+		return precedes(dbChirpCursor(visible[i]), dbChirpCursor(visible[j]))
+	})
+
+	visible, next, prev := paginate(visible, page, dbChirpCursor, precedes)
+
+	// Keep handing out a cursor at the newest end of the listing so clients
+	// can poll for chirps posted since: next on the last page when oldest
+	// first, prev on the first page when newest first.
+	if sortDirection == "desc" {
+		if prev == nil && len(visible) > 0 {
+			c := dbChirpCursor(visible[0])
+			prev = &c
+		} else if prev == nil {
+			prev = page.before
+		}
+	} else if next == nil && len(visible) > 0 {
+		c := dbChirpCursor(visible[len(visible)-1])
+		next = &c
+	} else if next == nil {
+		next = page.after
+	}
+
+	setPageLinks(w, r, page, next, prev)
+
+	chirps, err := cfg.renderChirps(caller, visible)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
 	}
 
 	respondWithJSON(w, http.StatusOK, chirps)
 }
 
-func validateChirp(body string) (string, error) {
-	const maxChirpLength = 140
+func chirpCursor(chirp Chirp) cursor {
+	return cursor{Id: chirp.Id, Created_At: chirp.Created_At}
+}
+
+func dbChirpCursor(chirp database.Chirp) cursor {
+	return cursor{Id: chirp.Id, Created_At: chirp.Created_At}
+}
+
+func (cfg *apiConfig) handlerEditChirp(w http.ResponseWriter, r *http.Request) {
+	type inputs struct {
+		Body string `json:"body"`
+	}
+
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return
+	}
+
+	user, entitlements, err := cfg.entitlementsFor(userId)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
 
-	if len(body) > maxChirpLength {
-		return "", errors.New("Chirp is too long")
+	if user.Is_Suspended {
+		respondWithError(w, http.StatusForbidden, suspensionMessage(user))
+		return
+	}
+
+	if entitlements.Edit_Window_Seconds == 0 {
+		respondWithError(w, http.StatusForbidden, "Your plan does not include editing chirps")
+		return
+	}
+
+	dbChirp, err := cfg.DB.GetChirp(id)
+
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirp")
+		return
+	}
+
+	if dbChirp.Author_Id != userId {
+		respondWithError(w, http.StatusForbidden, "User does not own Chirp, did not edit")
+		return
+	}
+
+	editDeadline := dbChirp.Created_At.Add(time.Duration(entitlements.Edit_Window_Seconds) * time.Second)
+
+	if time.Now().UTC().After(editDeadline) {
+		respondWithError(w, http.StatusForbidden, "Chirp can no longer be edited")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	input := inputs{}
+	err = decoder.Decode(&input)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	cleaned, flagged, err := cfg.filterChirp(input.Body, entitlements.Max_Chirp_Length)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entities, err := cfg.resolveMentions(parseEntities(cleaned))
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not resolve mentions")
+		return
 	}
 
-	return cleanChirp(body), nil
+	previousEntities := dbChirp.Entities
+
+	dbChirp, err = cfg.DB.UpdateChirp(id, cleaned, entities)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not edit Chirp")
+		return
+	}
+
+	cfg.Trends.Remove(dbChirp.Id)
+	cfg.Trends.Record(dbChirp)
+	cfg.emitEvent("chirp.updated", []int{dbChirp.Author_Id}, dbChirp)
+	cfg.federateChirp("chirp.updated", dbChirp)
+
+	if len(flagged) > 0 {
+		cfg.reportFlaggedChirp(dbChirp, flagged)
+	}
+
+	err = cfg.notifyMentions(dbChirp, previousEntities)
+
+	if err != nil {
+		log.Printf("Could not notify mentions: %s", err)
+	}
+
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	chirp, err := cfg.renderChirp(caller, dbChirp)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+func (cfg *apiConfig) handlerGetChirpHistory(w http.ResponseWriter, r *http.Request) {
+	_, dbChirp, ok := cfg.loadVisibleChirp(w, r)
+
+	if !ok {
+		return
+	}
+
+	history, err := cfg.DB.GetChirpHistory(dbChirp.Id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirp history")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, history)
+}
+
+// urlLength is what every URL counts for towards the chirp length, however
+// long it really is.
+const urlLength = 23
+
+func validateChirp(body string, maxLength int) (string, error) {
+	if !utf8.ValidString(body) {
+		return "", errors.New("Chirp is not valid UTF-8")
+	}
+
+	body = norm.NFC.String(body)
+
+	if strings.TrimFunc(body, isInvisible) == "" {
+		return "", errors.New("Chirp is empty")
+	}
+
+	if strings.ContainsFunc(body, func(r rune) bool {
+		return unicode.IsControl(r) && r != '\n' && r != '\t'
+	}) {
+		return "", errors.New("Chirp contains control characters")
+	}
+
+	if hasFormatCharacters(body) {
+		return "", errors.New("Chirp contains invisible formatting characters")
+	}
+
+	if chirpLength(body) > maxLength {
+		return "", fmt.Errorf("Chirp is too long, the maximum is %d characters", maxLength)
+	}
+
+	return body, nil
 
 }
 
-func cleanChirp(input string) string {
-	replaceValues := []string{"kerfuffle", "sharbert", "fornax"}
-	words := strings.Split(input, " ")
-	replacement := "****"
+// isInvisible reports whether r renders as nothing: whitespace, format
+// characters such as zero-width spaces, and the Hangul fillers that are
+// often used to post blank-looking chirps.
+func isInvisible(r rune) bool {
+	switch r {
+	case '\u115f', '\u1160', '\u3164', '\uffa0':
+		return true
+	}
+
+	return unicode.IsSpace(r) || unicode.Is(unicode.Cf, r)
+}
 
-	for i, word := range words {
-		for _, val := range replaceValues {
-			if strings.ToLower(word) == val {
-				words[i] = replacement
+// hasFormatCharacters reports whether body contains format (Cf) characters
+// other than the joiners and tags that make up emoji sequences, such as the
+// zero-width joiner in a family emoji or the tags in a subdivision flag.
+func hasFormatCharacters(body string) bool {
+	runes := []rune(body)
+
+	for i, r := range runes {
+		if !unicode.Is(unicode.Cf, r) {
+			continue
+		}
 
+		switch {
+		case r == '\u200c' || r == '\u200d':
+			if !isEmojiNeighbour(runes, i-1, -1) || !isEmojiNeighbour(runes, i+1, 1) {
+				return true
 			}
+		case r >= '\U000e0020' && r <= '\U000e007f':
+			if !isEmojiNeighbour(runes, i-1, -1) {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+// isEmojiNeighbour reports whether the rune at i, stepping by step past
+// variation selectors, skin tone modifiers and emoji tags, is an emoji.
+func isEmojiNeighbour(runes []rune, i, step int) bool {
+	for ; i >= 0 && i < len(runes); i += step {
+		r := runes[i]
+
+		if unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Sk, r) || (r >= '\U000e0020' && r <= '\U000e007f') {
+			continue
 		}
+
+		return unicode.Is(unicode.So, r)
+	}
+
+	return false
+}
+
+// filterChirp validates body and runs it through the content filter,
+// returning the masked body and the words that flag it for review.
+func (cfg *apiConfig) filterChirp(body string, maxLength int) (string, []string, error) {
+	validated, err := validateChirp(body, maxLength)
+
+	if err != nil {
+		return "", nil, err
 	}
 
-	return strings.Join(words, " ")
+	result := cfg.Filter.Apply(validated)
+
+	if result.Rejected {
+		return "", nil, errors.New("Chirp contains prohibited content")
+	}
+
+	return result.Body, result.Flagged, nil
+}
+
+// chirpLength counts user-perceived characters (grapheme clusters), so an
+// emoji or a letter with combining accents counts once. URLs count as
+// urlLength each regardless of their real length.
+func chirpLength(body string) int {
+	length := 0
+	start := 0
+
+	for _, entity := range parseEntities(body) {
+		if entity.Type != "url" {
+			continue
+		}
+
+		length += uniseg.GraphemeClusterCount(body[start:entity.Start]) + urlLength
+		start = entity.End
+	}
 
+	return length + uniseg.GraphemeClusterCount(body[start:])
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const adminUsage = `usage: chirpy admin <command> [arguments]
+
+commands:
+  users [query]              list users, optionally matching email or handle
+  user <id>                  show a user
+  set-role <id> <role>       set a user's role (user, moderator, admin)
+  grant-red <id> [days]      grant Chirpy Red, for 30 days by default
+  revoke-red <id>            revoke Chirpy Red
+  suspend <id> [reason]      suspend a user
+  unsuspend <id>             lift a suspension
+  reset-password <id>        revoke sessions and issue a password reset token
+  revoke-sessions <id>       log a user out everywhere`
+
+// adminCommandActions names the audit log action of each subcommand that
+// changes a user, matching the actions recorded by the admin API.
+var adminCommandActions = map[string]string{
+	"set-role":        "admin.set_role",
+	"grant-red":       "admin.grant_chirpy_red",
+	"revoke-red":      "admin.revoke_chirpy_red",
+	"suspend":         "admin.suspend",
+	"unsuspend":       "admin.unsuspend",
+	"reset-password":  "admin.password_reset",
+	"revoke-sessions": "admin.revoke_sessions",
+}
+
+// runAdmin runs a `chirpy admin` subcommand against db, writing JSON results
+// to out. It works on the same store as the server, which rereads the
+// database file on every request and shares its lock file, so it can be used
+// while the server runs.
+// Changes are recorded in the audit log with an actor id of 0.
+func runAdmin(db *database.DB, auditLog *database.AuditLog, args []string, out io.Writer) (err error) {
+	if len(args) == 0 {
+		return errors.New(adminUsage)
+	}
+
+	command, args := args[0], args[1:]
+
+	if command == "users" {
+		users, err := findUsers(db, strings.Join(args, " "))
+
+		if err != nil {
+			return err
+		}
+
+		adminUsers, err := loadAdminUsers(db, users)
+
+		if err != nil {
+			return err
+		}
+
+		return writeAdminJSON(out, adminUsers)
+	}
+
+	if len(args) == 0 {
+		return errors.New(adminUsage)
+	}
+
+	id, err := strconv.Atoi(args[0])
+
+	if err != nil {
+		return fmt.Errorf("invalid user id %q", args[0])
+	}
+
+	_, err = db.GetUser(id)
+
+	if err != nil {
+		return err
+	}
+
+	if action, ok := adminCommandActions[command]; ok {
+		if command == "set-role" && len(args) == 2 {
+			action += "." + args[1]
+		}
+
+		defer func() {
+			outcome := auditSuccess
+
+			if err != nil {
+				outcome = auditFailure
+			}
+
+			_, auditErr := auditLog.Append(database.AuditEntry{
+				Action:     action,
+				Target:     auditTarget("user", id),
+				User_Agent: "chirpy admin",
+				Outcome:    outcome,
+			})
+
+			if err == nil {
+				err = auditErr
+			}
+		}()
+	}
+
+	switch command {
+	case "user":
+	case "set-role":
+		if len(args) != 2 {
+			return errors.New(adminUsage)
+		}
+
+		err = validateRole(args[1])
+
+		if err != nil {
+			return err
+		}
+
+		err = db.SetUserRole(id, args[1])
+	case "grant-red":
+		var periodEnd *time.Time
+		periodEnd, err = parseGrantDays(args[1:])
+
+		if err != nil {
+			return err
+		}
+
+		err = grantChirpyRed(db, id, "", periodEnd)
+	case "revoke-red":
+		err = revokeChirpyRed(db, id)
+	case "suspend":
+		err = db.SuspendUser(id, strings.Join(args[1:], " "))
+	case "unsuspend":
+		err = db.UnsuspendUser(id)
+	case "revoke-sessions":
+		err = db.RevokeSessions(id)
+	case "reset-password":
+		var reset PasswordResetToken
+		reset, err = createPasswordReset(db, id)
+
+		if err != nil {
+			return err
+		}
+
+		return writeAdminJSON(out, reset)
+	default:
+		return errors.New(adminUsage)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	user, err := db.GetUser(id)
+
+	if err != nil {
+		return err
+	}
+
+	adminUsers, err := loadAdminUsers(db, []database.User{user})
+
+	if err != nil {
+		return err
+	}
+
+	return writeAdminJSON(out, adminUsers[0])
+}
+
+// parseGrantDays reads the optional length of a grant in days, returning nil
+// for the default of one billing period.
+func parseGrantDays(args []string) (*time.Time, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	days, err := strconv.Atoi(args[0])
+
+	if err != nil || days < 1 {
+		return nil, fmt.Errorf("invalid number of days %q", args[0])
+	}
+
+	end := time.Now().UTC().AddDate(0, 0, days)
+
+	return &end, nil
+}
+
+func writeAdminJSON(out io.Writer, value interface{}) error {
+	dat, err := json.MarshalIndent(value, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(out, string(dat))
+
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+func (cfg *apiConfig) handlerLikeChirp(w http.ResponseWriter, r *http.Request) {
+	cfg.updateEngagement(w, r, cfg.DB.LikeChirp, "like")
+}
+
+func (cfg *apiConfig) handlerUnlikeChirp(w http.ResponseWriter, r *http.Request) {
+	cfg.updateEngagement(w, r, cfg.DB.UnlikeChirp, "")
+}
+
+func (cfg *apiConfig) handlerRechirp(w http.ResponseWriter, r *http.Request) {
+	cfg.updateEngagement(w, r, cfg.DB.Rechirp, "rechirp")
+}
+
+func (cfg *apiConfig) handlerUnrechirp(w http.ResponseWriter, r *http.Request) {
+	cfg.updateEngagement(w, r, cfg.DB.Unrechirp, "")
+}
+
+// updateEngagement applies update to the chirp in the path and, when
+// notificationType is set, notifies its author.
+func (cfg *apiConfig) updateEngagement(w http.ResponseWriter, r *http.Request, update func(chirpId, userId int) error, notificationType string) {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	_, chirp, ok := cfg.loadVisibleChirp(w, r)
+
+	if !ok {
+		return
+	}
+
+	err = update(chirp.Id, userId)
+
+	if errors.Is(err, database.ErrChirpNotFound) || errors.Is(err, database.ErrBlocked) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not update Chirp")
+		return
+	}
+
+	if notificationType != "" {
+		err = cfg.notify(database.Notification{
+			User_Id:  chirp.Author_Id,
+			Type:     notificationType,
+			Actor_Id: userId,
+			Chirp_Id: chirp.Id,
+		})
+
+		if err != nil {
+			log.Printf("Could not notify author of chirp %d: %s", chirp.Id, err)
+		}
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+func (cfg *apiConfig) handlerGetLikes(w http.ResponseWriter, r *http.Request) {
+	caller, chirp, ok := cfg.loadVisibleChirp(w, r)
+
+	if !ok {
+		return
+	}
+
+	likes, err := cfg.DB.GetLikes(chirp.Id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve likes")
+		return
+	}
+
+	dbUsers, err := cfg.DB.GetUsers()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retreive users")
+		return
+	}
+
+	usersById := map[int]database.User{}
+
+	for _, dbUser := range dbUsers {
+		usersById[dbUser.Id] = dbUser
+	}
+
+	users := []PublicUser{}
+
+	for _, like := range likes {
+		dbUser, ok := usersById[like.User_Id]
+
+		if !ok || !caller.canSee(dbUser.Id) {
+			continue
+		}
+
+		users = append(users, publicUserFromDB(dbUser))
+	}
+
+	respondWithJSON(w, http.StatusOK, users)
+}
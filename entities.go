@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const maxHandleLength = 15
+
+// parseEntities extracts hashtags, @mentions and http(s) URLs from a chirp
+// body. Hashtag and mention values are lowercased without their sigil so they
+// can be used as lookup keys.
+func parseEntities(body string) []database.Entity {
+	entities := []database.Entity{}
+	runeIndex := 0
+
+	for i := 0; i < len(body); {
+		r, size := utf8.DecodeRuneInString(body[i:])
+		prev, _ := utf8.DecodeLastRuneInString(body[:i])
+		atBoundary := i == 0 || !isEntityRune(prev)
+
+		end := 0
+		entityType := ""
+
+		switch {
+		case atBoundary && (r == '#' || r == '@'):
+			end = i + size
+			for end < len(body) {
+				next, nextSize := utf8.DecodeRuneInString(body[end:])
+				if !isEntityRune(next) || (r == '@' && next > unicode.MaxASCII) {
+					break
+				}
+				end += nextSize
+			}
+
+			value := body[i+size : end]
+
+			if r == '#' && strings.IndexFunc(value, unicode.IsLetter) != -1 {
+				entityType = "hashtag"
+			}
+
+			if r == '@' && value != "" && len(value) <= maxHandleLength {
+				entityType = "mention"
+			}
+		case atBoundary && (strings.HasPrefix(body[i:], "http://") || strings.HasPrefix(body[i:], "https://")):
+			end = i + strings.IndexFunc(body[i:]+" ", unicode.IsSpace)
+			end = i + len(strings.TrimRight(body[i:end], ".,;:!?)'\""))
+
+			if !strings.HasSuffix(body[i:end], "://") {
+				entityType = "url"
+			}
+		}
+
+		if entityType == "" {
+			i += size
+			runeIndex++
+			continue
+		}
+
+		text := body[i:end]
+		value := text
+
+		if entityType != "url" {
+			value = strings.ToLower(text[1:])
+		}
+
+		runeCount := utf8.RuneCountInString(text)
+
+		entities = append(entities, database.Entity{
+			Type:       entityType,
+			Value:      value,
+			Start:      i,
+			End:        end,
+			Rune_Start: runeIndex,
+			Rune_End:   runeIndex + runeCount,
+		})
+
+		i = end
+		runeIndex += runeCount
+	}
+
+	return entities
+}
+
+func isEntityRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// resolveMentions fills in User_Id on mention entities whose handle belongs
+// to a user. Mentions of unknown handles are kept with a zero User_Id.
+func (cfg *apiConfig) resolveMentions(entities []database.Entity) ([]database.Entity, error) {
+	resolved := make([]database.Entity, 0, len(entities))
+
+	for _, entity := range entities {
+		if entity.Type == "mention" {
+			user, err := cfg.DB.GetUserByHandle(entity.Value)
+
+			if err != nil && !errors.Is(err, database.ErrUserNotFound) {
+				return nil, err
+			}
+
+			entity.User_Id = user.Id
+		}
+
+		resolved = append(resolved, entity)
+	}
+
+	return resolved, nil
+}
+
+// notifyMentions creates a mention notification for every user mentioned in
+// chirp who was not already mentioned in previous. The author of the chirp
+// being replied to is told of the reply instead.
+func (cfg *apiConfig) notifyMentions(chirp database.Chirp, previous []database.Entity) error {
+	notified := map[int]bool{0: true, chirp.Author_Id: true}
+
+	for _, entity := range previous {
+		notified[entity.User_Id] = true
+	}
+
+	repliedToId := 0
+
+	if chirp.In_Reply_To != 0 {
+		repliedTo, err := cfg.DB.GetChirp(chirp.In_Reply_To)
+
+		if err == nil {
+			repliedToId = repliedTo.Author_Id
+		}
+	}
+
+	for _, entity := range chirp.Entities {
+		if entity.Type != "mention" || notified[entity.User_Id] {
+			continue
+		}
+
+		notified[entity.User_Id] = true
+
+		blocked, err := cfg.DB.IsBlocked(entity.User_Id, chirp.Author_Id)
+
+		if err != nil {
+			return err
+		}
+
+		if blocked {
+			continue
+		}
+
+		if entity.User_Id != repliedToId {
+			err = cfg.notify(database.Notification{
+				User_Id:  entity.User_Id,
+				Type:     "mention",
+				Actor_Id: chirp.Author_Id,
+				Chirp_Id: chirp.Id,
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		cfg.emitEvent("mention", []int{entity.User_Id}, mentionData{User_Id: entity.User_Id, Chirp: chirp})
+	}
+
+	return nil
+}
+
+// queryHashtagChirps returns the chirps with the hashtag that the caller can
+// see.
+func (cfg *apiConfig) queryHashtagChirps(caller viewer, tag string) ([]database.Chirp, error) {
+	dbChirps, err := cfg.DB.GetChirpsByHashtag(tag)
+
+	if err != nil {
+		return nil, err
+	}
+
+	visible := []database.Chirp{}
+
+	for _, chirp := range dbChirps {
+		if caller.canSee(chirp.Author_Id) {
+			visible = append(visible, chirp)
+		}
+	}
+
+	return visible, nil
+}
+
+func (cfg *apiConfig) handlerGetHashtagChirps(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePageRequest(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	tag := strings.TrimPrefix(r.PathValue("tag"), "#")
+
+	visible, err := cfg.queryHashtagChirps(caller, tag)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
+	}
+
+	sort.Slice(visible, func(i, j int) bool {
+		return newestFirst(dbChirpCursor(visible[i]), dbChirpCursor(visible[j]))
+	})
+
+	visible, next, prev := paginate(visible, page, dbChirpCursor, newestFirst)
+	setPageLinks(w, r, page, next, prev)
+
+	chirps, err := cfg.renderChirps(caller, visible)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirps)
+}
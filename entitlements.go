@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const freePlan = "free"
+
+// Entitlements are the capabilities a plan grants. A zero Edit_Window_Seconds
+// means chirps cannot be edited and a zero Chirps_Per_Minute means posting is
+// not rate limited.
+type Entitlements struct {
+	Max_Chirp_Length    int  `json:"max_chirp_length"`
+	Edit_Window_Seconds int  `json:"edit_window_seconds"`
+	Scheduled_Chirps    bool `json:"scheduled_chirps"`
+	Max_Media_Bytes     int  `json:"max_media_bytes"`
+	Chirps_Per_Minute   int  `json:"chirps_per_minute"`
+	Custom_Themes       bool `json:"custom_themes"`
+}
+
+var defaultEntitlements = map[string]Entitlements{
+	freePlan: {
+		Max_Chirp_Length:  140,
+		Chirps_Per_Minute: 10,
+	},
+	defaultPlan: {
+		Max_Chirp_Length:    280,
+		Edit_Window_Seconds: 300,
+		Scheduled_Chirps:    true,
+		Max_Media_Bytes:     10 << 20,
+		Chirps_Per_Minute:   60,
+		Custom_Themes:       true,
+	},
+}
+
+type PlanEntitlements struct {
+	Plan         string       `json:"plan"`
+	Entitlements Entitlements `json:"entitlements"`
+}
+
+// entitlementStore maps plans to entitlements, loaded from a JSON object
+// keyed by plan name. The file must define the free plan, which is also
+// used for users on a plan it does not list.
+type entitlementStore struct {
+	mux   *sync.RWMutex
+	path  string
+	plans map[string]Entitlements
+}
+
+func newEntitlementStore(path string) (*entitlementStore, error) {
+	store := &entitlementStore{
+		mux:   &sync.RWMutex{},
+		path:  path,
+		plans: defaultEntitlements,
+	}
+
+	err := store.Reload()
+
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+
+	return store, err
+}
+
+func (store *entitlementStore) Reload() error {
+	dat, err := os.ReadFile(store.path)
+
+	if err != nil {
+		return err
+	}
+
+	plans := map[string]Entitlements{}
+	err = json.Unmarshal(dat, &plans)
+
+	if err != nil {
+		return err
+	}
+
+	if _, ok := plans[freePlan]; !ok {
+		return fmt.Errorf("entitlements must define the %s plan", freePlan)
+	}
+
+	for plan, entitlements := range plans {
+		if entitlements.Max_Chirp_Length <= 0 {
+			return fmt.Errorf("plan %s must allow chirps of at least one character", plan)
+		}
+
+		if entitlements.Edit_Window_Seconds < 0 || entitlements.Max_Media_Bytes < 0 || entitlements.Chirps_Per_Minute < 0 {
+			return fmt.Errorf("plan %s has a negative limit", plan)
+		}
+	}
+
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	store.plans = plans
+
+	return nil
+}
+
+func (store *entitlementStore) Plans() map[string]Entitlements {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+
+	plans := make(map[string]Entitlements, len(store.plans))
+
+	for plan, entitlements := range store.plans {
+		plans[plan] = entitlements
+	}
+
+	return plans
+}
+
+// For returns the plan the user is on and what it entitles them to.
+func (store *entitlementStore) For(user database.User) PlanEntitlements {
+	store.mux.RLock()
+	defer store.mux.RUnlock()
+
+	plan := userPlan(user)
+	entitlements, ok := store.plans[plan]
+
+	if !ok {
+		plan = freePlan
+		entitlements = store.plans[freePlan]
+	}
+
+	return PlanEntitlements{Plan: plan, Entitlements: entitlements}
+}
+
+// userPlan returns the plan of an entitled subscription, or the free plan.
+func userPlan(user database.User) string {
+	if user.Subscription.Entitled() && user.Subscription.Plan != "" {
+		return user.Subscription.Plan
+	}
+
+	return freePlan
+}
+
+func (cfg *apiConfig) entitlementsFor(userId int) (database.User, Entitlements, error) {
+	user, err := cfg.DB.GetUser(userId)
+
+	if err != nil {
+		return database.User{}, Entitlements{}, err
+	}
+
+	return user, cfg.Entitlements.For(user).Entitlements, nil
+}
+
+// rateLimiter counts events per user over a sliding minute.
+type rateLimiter struct {
+	mux    *sync.Mutex
+	events map[int][]time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		mux:    &sync.Mutex{},
+		events: map[int][]time.Time{},
+	}
+}
+
+// Allow records an event for the user if fewer than limit happened in the
+// last minute. Otherwise it returns how long until the oldest one expires.
+func (limiter *rateLimiter) Allow(userId, limit int, now time.Time) (bool, time.Duration) {
+	if limit <= 0 {
+		return true, 0
+	}
+
+	limiter.mux.Lock()
+	defer limiter.mux.Unlock()
+
+	recent := limiter.events[userId][:0]
+
+	for _, at := range limiter.events[userId] {
+		if now.Sub(at) < time.Minute {
+			recent = append(recent, at)
+		}
+	}
+
+	if len(recent) >= limit {
+		limiter.events[userId] = recent
+		return false, time.Minute - now.Sub(recent[0])
+	}
+
+	limiter.events[userId] = append(recent, now)
+
+	return true, 0
+}
+
+// allowChirp applies the user's posting rate limit, responding with 429 when
+// it is exceeded.
+func (cfg *apiConfig) allowChirp(w http.ResponseWriter, userId int, entitlements Entitlements) bool {
+	ok, retryAfter := cfg.ChirpLimiter.Allow(userId, entitlements.Chirps_Per_Minute, time.Now())
+
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		respondWithError(w, http.StatusTooManyRequests, fmt.Sprintf("You can post %d chirps per minute", entitlements.Chirps_Per_Minute))
+		return false
+	}
+
+	return true
+}
+
+func (cfg *apiConfig) handlerGetEntitlements(w http.ResponseWriter, r *http.Request) {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(userId)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.Entitlements.For(user))
+}
+
+func (cfg *apiConfig) handlerGetPlans(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, cfg.Entitlements.Plans())
+}
+
+func (cfg *apiConfig) handlerReloadEntitlements(w http.ResponseWriter, r *http.Request) {
+	err := cfg.Entitlements.Reload()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Could not reload entitlements: %v", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.Entitlements.Plans())
+}
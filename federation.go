@@ -0,0 +1,1205 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const (
+	activityContentType   = "application/activity+json"
+	activityStreamsPublic = "https://www.w3.org/ns/activitystreams#Public"
+
+	maxActivitySize = 1 << 20
+	outboxSize      = 20
+	remoteActorTTL  = time.Hour
+)
+
+var activityContext = []string{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"}
+
+// errInvalidActivity is wrapped by errors about activities we cannot accept,
+// as opposed to our own failures processing them.
+var errInvalidActivity = errors.New("invalid activity")
+
+// Actor is the ActivityPub view of a user. Only users with a handle are
+// federated, as other servers address them by it.
+type Actor struct {
+	Context            []string       `json:"@context"`
+	Id                 string         `json:"id"`
+	Type               string         `json:"type"`
+	Preferred_Username string         `json:"preferredUsername"`
+	Name               string         `json:"name"`
+	Url                string         `json:"url"`
+	Inbox              string         `json:"inbox"`
+	Outbox             string         `json:"outbox"`
+	Followers          string         `json:"followers"`
+	Endpoints          actorEndpoints `json:"endpoints"`
+	Public_Key         actorPublicKey `json:"publicKey"`
+}
+
+type actorEndpoints struct {
+	Shared_Inbox string `json:"sharedInbox,omitempty"`
+}
+
+type actorPublicKey struct {
+	Id             string `json:"id"`
+	Owner          string `json:"owner"`
+	Public_Key_Pem string `json:"publicKeyPem"`
+}
+
+// Note is a chirp as an ActivityPub object.
+type Note struct {
+	Context       []string   `json:"@context,omitempty"`
+	Id            string     `json:"id"`
+	Type          string     `json:"type"`
+	Attributed_To string     `json:"attributedTo,omitempty"`
+	Content       string     `json:"content,omitempty"`
+	Url           string     `json:"url,omitempty"`
+	Published     *time.Time `json:"published,omitempty"`
+	Updated       *time.Time `json:"updated,omitempty"`
+	To            []string   `json:"to,omitempty"`
+	Cc            []string   `json:"cc,omitempty"`
+	In_Reply_To   string     `json:"inReplyTo,omitempty"`
+	Tag           []noteTag  `json:"tag,omitempty"`
+}
+
+type noteTag struct {
+	Type string `json:"type"`
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+type Activity struct {
+	Context   []string    `json:"@context,omitempty"`
+	Id        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Published time.Time   `json:"published"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+	Object    interface{} `json:"object"`
+}
+
+type OrderedCollection struct {
+	Context       []string   `json:"@context"`
+	Id            string     `json:"id"`
+	Type          string     `json:"type"`
+	Total_Items   int        `json:"totalItems"`
+	Ordered_Items []Activity `json:"orderedItems,omitempty"`
+}
+
+// inboundActivity is an activity from another server. Its object may be an
+// id or the object itself.
+type inboundActivity struct {
+	Id     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// remoteActor is the part of another server's actor we use.
+type remoteActor struct {
+	Id         string         `json:"id"`
+	Inbox      string         `json:"inbox"`
+	Endpoints  actorEndpoints `json:"endpoints"`
+	Public_Key actorPublicKey `json:"publicKey"`
+}
+
+type cachedActor struct {
+	actor     remoteActor
+	fetchedAt time.Time
+}
+
+// federation sends queued activities and caches the actors of other
+// servers. Queueing wakes it so new activities go out straight away rather
+// than on the next tick. inFlight holds the ids of deliveries being sent and
+// busy the number of requests per inbox. allowPrivate lets it reach actors
+// over plain http and on private addresses, for testing against a local
+// server.
+type federation struct {
+	client       *http.Client
+	allowPrivate bool
+	wake         chan struct{}
+	mux          *sync.Mutex
+	actors       map[string]cachedActor
+	inFlight     map[int]bool
+	busy         map[string]int
+}
+
+func newFederation(allowPrivate bool) *federation {
+	client := newPublicClient(deliveryTimeout)
+
+	if allowPrivate {
+		log.Printf("FEDERATION_ALLOW_PRIVATE is set: federating over http and with private addresses, for development only")
+		client = &http.Client{Timeout: deliveryTimeout}
+	}
+
+	return &federation{
+		client:       client,
+		allowPrivate: allowPrivate,
+		wake:         make(chan struct{}, 1),
+		mux:          &sync.Mutex{},
+		actors:       map[string]cachedActor{},
+		inFlight:     map[int]bool{},
+		busy:         map[string]int{},
+	}
+}
+
+// claim reserves a worker for the delivery, failing when it is already being
+// sent or its inbox or the federation has no worker free. Inboxes share the
+// webhook dispatcher's limits.
+func (fed *federation) claim(delivery database.FederationDelivery) bool {
+	fed.mux.Lock()
+	defer fed.mux.Unlock()
+
+	if fed.inFlight[delivery.Id] || len(fed.inFlight) >= maxDeliveryWorkers ||
+		fed.busy[delivery.Inbox] >= deliveryWorkersPerEndpoint {
+		return false
+	}
+
+	fed.inFlight[delivery.Id] = true
+	fed.busy[delivery.Inbox]++
+
+	return true
+}
+
+func (fed *federation) release(delivery database.FederationDelivery) {
+	fed.mux.Lock()
+	defer fed.mux.Unlock()
+
+	delete(fed.inFlight, delivery.Id)
+	fed.busy[delivery.Inbox]--
+
+	if fed.busy[delivery.Inbox] == 0 {
+		delete(fed.busy, delivery.Inbox)
+	}
+}
+
+func (fed *federation) Wake() {
+	select {
+	case fed.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (cfg *apiConfig) actorUrl(userId int) string {
+	return fmt.Sprintf("%s/users/%d", cfg.BaseURL, userId)
+}
+
+func (cfg *apiConfig) noteUrl(chirpId int) string {
+	return fmt.Sprintf("%s/chirps/%d", cfg.BaseURL, chirpId)
+}
+
+func (cfg *apiConfig) federationHost() string {
+	parsed, err := url.Parse(cfg.BaseURL)
+
+	if err != nil {
+		return ""
+	}
+
+	return parsed.Host
+}
+
+// localId returns the id in uri if it is one of ours under prefix, as with
+// actor and note ids.
+func (cfg *apiConfig) localId(uri, prefix string) (int, bool) {
+	rest, ok := strings.CutPrefix(uri, cfg.BaseURL+prefix)
+
+	if !ok {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(rest)
+
+	return id, err == nil
+}
+
+func federated(user database.User) bool {
+	return user.Handle != "" && !user.Is_Suspended
+}
+
+// loadFederatedUser loads the {id} user, responding with 404 unless they are
+// federated.
+func (cfg *apiConfig) loadFederatedUser(w http.ResponseWriter, r *http.Request) (database.User, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return database.User{}, false
+	}
+
+	user, err := cfg.DB.GetUser(id)
+
+	if errors.Is(err, database.ErrUserNotFound) || (err == nil && !federated(user)) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return database.User{}, false
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve user")
+		return database.User{}, false
+	}
+
+	return user, true
+}
+
+// actorKey returns the user's key pair, generating it the first time.
+func (cfg *apiConfig) actorKey(userId int) (database.ActorKey, error) {
+	key, ok, err := cfg.DB.GetActorKey(userId)
+
+	if err != nil || ok {
+		return key, err
+	}
+
+	privatePem, publicPem, err := generateKeyPair()
+
+	if err != nil {
+		return database.ActorKey{}, err
+	}
+
+	return cfg.DB.CreateActorKey(userId, database.ActorKey{
+		Private_Key_Pem: privatePem,
+		Public_Key_Pem:  publicPem,
+	})
+}
+
+func respondWithActivity(w http.ResponseWriter, code int, payload interface{}) {
+	dat, err := json.Marshal(payload)
+
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", activityContentType)
+	w.WriteHeader(code)
+	w.Write(dat)
+}
+
+// handlerWebFinger resolves acct:handle@host, or an actor's id, to the
+// actor, which is how other servers find a user from their address.
+func (cfg *apiConfig) handlerWebFinger(w http.ResponseWriter, r *http.Request) {
+	type link struct {
+		Rel  string `json:"rel"`
+		Type string `json:"type"`
+		Href string `json:"href"`
+	}
+
+	type response struct {
+		Subject string   `json:"subject"`
+		Aliases []string `json:"aliases"`
+		Links   []link   `json:"links"`
+	}
+
+	resource := r.URL.Query().Get("resource")
+
+	if resource == "" {
+		respondWithError(w, http.StatusBadRequest, "resource is required")
+		return
+	}
+
+	user := database.User{}
+	err := database.ErrUserNotFound
+
+	if account, ok := strings.CutPrefix(resource, "acct:"); ok {
+		handle, host, _ := strings.Cut(account, "@")
+
+		if strings.EqualFold(host, cfg.federationHost()) {
+			user, err = cfg.DB.GetUserByHandle(handle)
+		}
+	} else if id, ok := cfg.localId(resource, "/users/"); ok {
+		user, err = cfg.DB.GetUser(id)
+	}
+
+	if errors.Is(err, database.ErrUserNotFound) || (err == nil && !federated(user)) {
+		respondWithError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve user")
+		return
+	}
+
+	actorUrl := cfg.actorUrl(user.Id)
+
+	dat, err := json.Marshal(response{
+		Subject: "acct:" + user.Handle + "@" + cfg.federationHost(),
+		Aliases: []string{actorUrl},
+		Links:   []link{{Rel: "self", Type: activityContentType, Href: actorUrl}},
+	})
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jrd+json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(dat)
+}
+
+func (cfg *apiConfig) handlerGetActor(w http.ResponseWriter, r *http.Request) {
+	user, ok := cfg.loadFederatedUser(w, r)
+
+	if !ok {
+		return
+	}
+
+	key, err := cfg.actorKey(user.Id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve key")
+		return
+	}
+
+	actorUrl := cfg.actorUrl(user.Id)
+
+	respondWithActivity(w, http.StatusOK, Actor{
+		Context:            activityContext,
+		Id:                 actorUrl,
+		Type:               "Person",
+		Preferred_Username: user.Handle,
+		Name:               user.Handle,
+		Url:                fmt.Sprintf("%s/api/chirps?author_id=%d", cfg.BaseURL, user.Id),
+		Inbox:              actorUrl + "/inbox",
+		Outbox:             actorUrl + "/outbox",
+		Followers:          actorUrl + "/followers",
+		Endpoints:          actorEndpoints{Shared_Inbox: cfg.BaseURL + "/inbox"},
+		Public_Key: actorPublicKey{
+			Id:             actorUrl + "#main-key",
+			Owner:          actorUrl,
+			Public_Key_Pem: key.Public_Key_Pem,
+		},
+	})
+}
+
+// handlerGetOutbox lists the newest Create activities for the user's chirps
+// and Delete activities for those they deleted.
+func (cfg *apiConfig) handlerGetOutbox(w http.ResponseWriter, r *http.Request) {
+	user, ok := cfg.loadFederatedUser(w, r)
+
+	if !ok {
+		return
+	}
+
+	dbChirps, err := cfg.queryChirps(viewer{}, strconv.Itoa(user.Id))
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
+	}
+
+	tombstones, err := cfg.DB.GetTombstones(user.Id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
+	}
+
+	activities := make([]Activity, 0, len(dbChirps)+len(tombstones))
+
+	for _, chirp := range dbChirps {
+		activities = append(activities, cfg.createActivity(chirp))
+	}
+
+	for _, tombstone := range tombstones {
+		activities = append(activities, cfg.deleteActivity(tombstone))
+	}
+
+	sort.SliceStable(activities, func(i, j int) bool {
+		return activities[i].Published.After(activities[j].Published)
+	})
+
+	total := len(activities)
+
+	if len(activities) > outboxSize {
+		activities = activities[:outboxSize]
+	}
+
+	for i := range activities {
+		activities[i].Context = nil
+	}
+
+	respondWithActivity(w, http.StatusOK, OrderedCollection{
+		Context:       activityContext,
+		Id:            cfg.actorUrl(user.Id) + "/outbox",
+		Type:          "OrderedCollection",
+		Total_Items:   total,
+		Ordered_Items: activities,
+	})
+}
+
+// handlerGetFollowers only gives the follower count, local and remote, as
+// most servers do.
+func (cfg *apiConfig) handlerGetFollowers(w http.ResponseWriter, r *http.Request) {
+	user, ok := cfg.loadFederatedUser(w, r)
+
+	if !ok {
+		return
+	}
+
+	followers, err := cfg.DB.GetFollowers(user.Id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve relationships")
+		return
+	}
+
+	remoteFollowers, err := cfg.DB.GetRemoteFollowers(user.Id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve relationships")
+		return
+	}
+
+	respondWithActivity(w, http.StatusOK, OrderedCollection{
+		Context:     activityContext,
+		Id:          cfg.actorUrl(user.Id) + "/followers",
+		Type:        "OrderedCollection",
+		Total_Items: len(followers) + len(remoteFollowers),
+	})
+}
+
+// handlerGetNote serves the chirp as a Note, or a Tombstone once deleted.
+func (cfg *apiConfig) handlerGetNote(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return
+	}
+
+	chirp, err := cfg.DB.GetChirp(id)
+
+	if errors.Is(err, database.ErrChirpNotFound) {
+		tombstone, ok, err := cfg.DB.GetTombstone(id)
+
+		if err != nil || !ok {
+			respondWithError(w, http.StatusNotFound, "Could not find Id")
+			return
+		}
+
+		respondWithActivity(w, http.StatusGone, Note{
+			Context: activityContext,
+			Id:      cfg.noteUrl(tombstone.Chirp_Id),
+			Type:    "Tombstone",
+		})
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirp")
+		return
+	}
+
+	author, err := cfg.DB.GetUser(chirp.Author_Id)
+
+	if err != nil || !federated(author) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
+
+	note := cfg.noteFromChirp(chirp)
+	note.Context = activityContext
+
+	respondWithActivity(w, http.StatusOK, note)
+}
+
+// noteFromChirp addresses the chirp to the public and the author's
+// followers. Mentions of local users are tagged so other servers link them.
+func (cfg *apiConfig) noteFromChirp(chirp database.Chirp) Note {
+	published := chirp.Created_At.UTC()
+	note := Note{
+		Id:            cfg.noteUrl(chirp.Id),
+		Type:          "Note",
+		Attributed_To: cfg.actorUrl(chirp.Author_Id),
+		Content:       "<p>" + html.EscapeString(chirp.Body) + "</p>",
+		Url:           fmt.Sprintf("%s/api/chirps/%d", cfg.BaseURL, chirp.Id),
+		Published:     &published,
+		To:            []string{activityStreamsPublic},
+		Cc:            []string{cfg.actorUrl(chirp.Author_Id) + "/followers"},
+		Tag:           []noteTag{},
+	}
+
+	if chirp.Updated_At.After(chirp.Created_At) {
+		updated := chirp.Updated_At.UTC()
+		note.Updated = &updated
+	}
+
+	if chirp.In_Reply_To != 0 {
+		note.In_Reply_To = cfg.noteUrl(chirp.In_Reply_To)
+	}
+
+	for _, entity := range chirp.Entities {
+		switch {
+		case entity.Type == "hashtag":
+			note.Tag = append(note.Tag, noteTag{
+				Type: "Hashtag",
+				Href: cfg.BaseURL + "/api/hashtags/" + url.PathEscape(entity.Value) + "/chirps",
+				Name: "#" + entity.Value,
+			})
+		case entity.Type == "mention" && entity.User_Id != 0:
+			note.Tag = append(note.Tag, noteTag{
+				Type: "Mention",
+				Href: cfg.actorUrl(entity.User_Id),
+				Name: "@" + entity.Value + "@" + cfg.federationHost(),
+			})
+			note.Cc = append(note.Cc, cfg.actorUrl(entity.User_Id))
+		}
+	}
+
+	return note
+}
+
+func (cfg *apiConfig) createActivity(chirp database.Chirp) Activity {
+	note := cfg.noteFromChirp(chirp)
+
+	return Activity{
+		Context:   activityContext,
+		Id:        note.Id + "/activity",
+		Type:      "Create",
+		Actor:     note.Attributed_To,
+		Published: *note.Published,
+		To:        note.To,
+		Cc:        note.Cc,
+		Object:    note,
+	}
+}
+
+// updateActivity sends an edited chirp's new contents. Each edit gets its
+// own activity id so remote servers do not discard it as a repeat.
+func (cfg *apiConfig) updateActivity(chirp database.Chirp) Activity {
+	note := cfg.noteFromChirp(chirp)
+
+	return Activity{
+		Context:   activityContext,
+		Id:        fmt.Sprintf("%s#update-%d", note.Id, chirp.Updated_At.UnixMilli()),
+		Type:      "Update",
+		Actor:     note.Attributed_To,
+		Published: chirp.Updated_At.UTC(),
+		To:        note.To,
+		Cc:        note.Cc,
+		Object:    note,
+	}
+}
+
+func (cfg *apiConfig) deleteActivity(tombstone database.Tombstone) Activity {
+	id := cfg.noteUrl(tombstone.Chirp_Id)
+
+	return Activity{
+		Context:   activityContext,
+		Id:        id + "#delete",
+		Type:      "Delete",
+		Actor:     cfg.actorUrl(tombstone.Author_Id),
+		Published: tombstone.Deleted_At.UTC(),
+		To:        []string{activityStreamsPublic},
+		Object:    Note{Id: id, Type: "Tombstone"},
+	}
+}
+
+// handlerInbox accepts activities from other servers, both to a user's
+// inbox and to the shared inbox. Every activity must be signed by its actor.
+func (cfg *apiConfig) handlerInbox(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("id") != "" {
+		if _, ok := cfg.loadFederatedUser(w, r); !ok {
+			return
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxActivitySize+1))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read activity")
+		return
+	}
+
+	if len(body) > maxActivitySize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Activity is too large")
+		return
+	}
+
+	actor, err := cfg.verifyActivity(r, body)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	activity := inboundActivity{}
+	err = json.Unmarshal(body, &activity)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode activity")
+		return
+	}
+
+	if activity.Actor != actor.Id {
+		respondWithError(w, http.StatusUnauthorized, "Activity is not signed by its actor")
+		return
+	}
+
+	switch activity.Type {
+	case "Follow":
+		err = cfg.receiveFollow(actor, activity, body)
+	case "Undo":
+		err = cfg.receiveUndo(actor, activity)
+	case "Like":
+		err = cfg.receiveLike(actor, activity)
+	case "Create":
+		err = cfg.receiveCreate(actor, activity)
+	case "Delete":
+		err = cfg.receiveDelete(actor, activity)
+	}
+
+	if errors.Is(err, errInvalidActivity) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err != nil {
+		log.Printf("Could not process %s activity %s: %s", activity.Type, activity.Id, err)
+		respondWithError(w, http.StatusInternalServerError, "Could not process activity")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// receiveFollow records the follow and accepts it. Follows are accepted
+// automatically, as every chirp is public.
+func (cfg *apiConfig) receiveFollow(actor remoteActor, activity inboundActivity, body []byte) error {
+	userId, ok := cfg.localId(objectId(activity.Object), "/users/")
+
+	if !ok {
+		return fmt.Errorf("%w: object must be a local actor", errInvalidActivity)
+	}
+
+	user, err := cfg.DB.GetUser(userId)
+
+	if errors.Is(err, database.ErrUserNotFound) || (err == nil && !federated(user)) {
+		return fmt.Errorf("%w: user not found", errInvalidActivity)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = cfg.DB.AddRemoteFollower(userId, database.RemoteFollower{
+		Actor:        actor.Id,
+		Inbox:        actor.Inbox,
+		Shared_Inbox: actor.Endpoints.Shared_Inbox,
+		Follow_Id:    activity.Id,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	accept := Activity{
+		Context:   activityContext,
+		Id:        cfg.actorUrl(userId) + "#accepts/" + randomActivityId(),
+		Type:      "Accept",
+		Actor:     cfg.actorUrl(userId),
+		Published: time.Now().UTC(),
+		Object:    json.RawMessage(body),
+	}
+
+	return cfg.queueActivity(userId, accept, []string{actor.Inbox})
+}
+
+// receiveUndo undoes a follow or like, identified by the embedded activity
+// or, failing that, by its id.
+func (cfg *apiConfig) receiveUndo(actor remoteActor, activity inboundActivity) error {
+	undone := inboundActivity{}
+
+	if json.Unmarshal(activity.Object, &undone) != nil {
+		return cfg.DB.UndoRemoteActivity(actor.Id, objectId(activity.Object))
+	}
+
+	if undone.Actor != "" && undone.Actor != actor.Id {
+		return fmt.Errorf("%w: cannot undo another actor's activity", errInvalidActivity)
+	}
+
+	switch undone.Type {
+	case "Follow":
+		if userId, ok := cfg.localId(objectId(undone.Object), "/users/"); ok {
+			return cfg.DB.RemoveRemoteFollower(userId, actor.Id)
+		}
+	case "Like":
+		if chirpId, ok := cfg.localId(objectId(undone.Object), "/chirps/"); ok {
+			return cfg.DB.RemoveRemoteLike(chirpId, actor.Id)
+		}
+	}
+
+	return cfg.DB.UndoRemoteActivity(actor.Id, undone.Id)
+}
+
+func (cfg *apiConfig) receiveLike(actor remoteActor, activity inboundActivity) error {
+	chirpId, ok := cfg.localId(objectId(activity.Object), "/chirps/")
+
+	if !ok {
+		return fmt.Errorf("%w: object must be a local note", errInvalidActivity)
+	}
+
+	err := cfg.DB.AddRemoteLike(chirpId, database.RemoteLike{
+		Actor:       actor.Id,
+		Activity_Id: activity.Id,
+	})
+
+	if errors.Is(err, database.ErrChirpNotFound) {
+		return fmt.Errorf("%w: chirp not found", errInvalidActivity)
+	}
+
+	return err
+}
+
+// receiveCreate keeps notes that reply to a local chirp or mention a local
+// user. Others are none of our business and are ignored.
+func (cfg *apiConfig) receiveCreate(actor remoteActor, activity inboundActivity) error {
+	note := Note{}
+
+	if json.Unmarshal(activity.Object, &note) != nil || note.Type != "Note" {
+		return nil
+	}
+
+	if note.Attributed_To != actor.Id {
+		return fmt.Errorf("%w: note is not attributed to the actor", errInvalidActivity)
+	}
+
+	replyTo, _ := cfg.localId(note.In_Reply_To, "/chirps/")
+	mentions := []int{}
+
+	for _, tag := range note.Tag {
+		if userId, ok := cfg.localId(tag.Href, "/users/"); ok && tag.Type == "Mention" {
+			mentions = append(mentions, userId)
+		}
+	}
+
+	if replyTo == 0 && len(mentions) == 0 {
+		return nil
+	}
+
+	published := time.Now().UTC()
+
+	if note.Published != nil {
+		published = *note.Published
+	}
+
+	return cfg.DB.SaveRemoteNote(database.RemoteNote{
+		Id:          note.Id,
+		Actor:       actor.Id,
+		Content:     stripHTML(note.Content),
+		In_Reply_To: replyTo,
+		Mentions:    mentions,
+		Published:   published,
+	})
+}
+
+// receiveDelete deletes one of the actor's notes, or everything from the
+// actor when it deletes itself.
+func (cfg *apiConfig) receiveDelete(actor remoteActor, activity inboundActivity) error {
+	id := objectId(activity.Object)
+
+	if id == actor.Id {
+		return cfg.DB.RemoveRemoteActor(actor.Id)
+	}
+
+	return cfg.DB.DeleteRemoteNote(id, actor.Id)
+}
+
+// objectId returns the id of an object given either as its id or in full.
+func objectId(object json.RawMessage) string {
+	id := ""
+
+	if json.Unmarshal(object, &id) == nil {
+		return id
+	}
+
+	embedded := struct {
+		Id string `json:"id"`
+	}{}
+
+	json.Unmarshal(object, &embedded)
+
+	return embedded.Id
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+var htmlBreakPattern = regexp.MustCompile(`(?i)<br\s*/?>|</p>`)
+
+func stripHTML(content string) string {
+	content = htmlBreakPattern.ReplaceAllString(content, "\n")
+	content = htmlTagPattern.ReplaceAllString(content, "")
+
+	return strings.TrimSpace(html.UnescapeString(content))
+}
+
+func randomActivityId() string {
+	dat := make([]byte, 16)
+	rand.Read(dat)
+
+	return hex.EncodeToString(dat)
+}
+
+// verifyActivity checks the request's HTTP signature against the key of the
+// actor its keyId belongs to, and returns that actor. A cached key that does
+// not verify is fetched again in case the actor has changed keys.
+func (cfg *apiConfig) verifyActivity(r *http.Request, body []byte) (remoteActor, error) {
+	sig, err := parseSignature(r, body)
+
+	if err != nil {
+		return remoteActor{}, err
+	}
+
+	actorId, _, _ := strings.Cut(sig.keyId, "#")
+
+	for _, refresh := range []bool{false, true} {
+		actor, cached, err := cfg.Federation.fetchActor(actorId, refresh)
+
+		if err != nil {
+			return remoteActor{}, errors.New("could not fetch the signing actor")
+		}
+
+		if actor.Public_Key.Id != sig.keyId || actor.Public_Key.Owner != actor.Id {
+			return remoteActor{}, errors.New("key does not belong to the actor")
+		}
+
+		key, err := parsePublicKey(actor.Public_Key.Public_Key_Pem)
+
+		if err == nil && sig.verify(r, key) == nil {
+			return actor, nil
+		}
+
+		if !cached {
+			break
+		}
+	}
+
+	return remoteActor{}, errors.New("signature does not verify")
+}
+
+// fetchActor returns the actor with id, from the cache unless refresh is
+// set or the cached copy is older than remoteActorTTL. cached reports
+// whether it came from the cache. Actors must be served over https unless
+// allowPrivate is set, and their inboxes must be on the same host, as we
+// deliver to them later.
+func (fed *federation) fetchActor(id string, refresh bool) (actor remoteActor, cached bool, err error) {
+	fed.mux.Lock()
+	entry, ok := fed.actors[id]
+	fed.mux.Unlock()
+
+	if ok && !refresh && time.Since(entry.fetchedAt) < remoteActorTTL {
+		return entry.actor, true, nil
+	}
+
+	parsed, err := url.Parse(id)
+
+	if err != nil || !fed.allowedScheme(parsed.Scheme) || parsed.Host == "" {
+		return remoteActor{}, false, errors.New("actor id must be an https URL")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, id, nil)
+
+	if err != nil {
+		return remoteActor{}, false, err
+	}
+
+	req.Header.Set("Accept", activityContentType)
+	req.Header.Set("User-Agent", "Chirpy-Federation")
+
+	resp, err := fed.client.Do(req)
+
+	if err != nil {
+		return remoteActor{}, false, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return remoteActor{}, false, fmt.Errorf("actor responded with %s", resp.Status)
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxActivitySize)).Decode(&actor)
+
+	if err != nil {
+		return remoteActor{}, false, err
+	}
+
+	if actor.Id != id || actor.Inbox == "" {
+		return remoteActor{}, false, errors.New("actor document is not the actor")
+	}
+
+	if !fed.onHost(actor.Inbox, parsed.Host) || (actor.Endpoints.Shared_Inbox != "" && !fed.onHost(actor.Endpoints.Shared_Inbox, parsed.Host)) {
+		return remoteActor{}, false, errors.New("actor inboxes must be on the actor's host")
+	}
+
+	fed.mux.Lock()
+	fed.actors[id] = cachedActor{actor: actor, fetchedAt: time.Now()}
+	fed.mux.Unlock()
+
+	return actor, false, nil
+}
+
+// onHost reports whether rawUrl is an allowed URL on host.
+func (fed *federation) onHost(rawUrl, host string) bool {
+	parsed, err := url.Parse(rawUrl)
+
+	return err == nil && fed.allowedScheme(parsed.Scheme) && strings.EqualFold(parsed.Host, host)
+}
+
+func (fed *federation) allowedScheme(scheme string) bool {
+	return scheme == "https" || (fed.allowPrivate && scheme == "http")
+}
+
+func (cfg *apiConfig) handlerGetRemoteReplies(w http.ResponseWriter, r *http.Request) {
+	_, parent, ok := cfg.loadVisibleChirp(w, r)
+
+	if !ok {
+		return
+	}
+
+	replies, err := cfg.DB.GetRemoteReplies(parent.Id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve replies")
+		return
+	}
+
+	sort.Slice(replies, func(i, j int) bool {
+		return replies[i].Published.Before(replies[j].Published)
+	})
+
+	respondWithJSON(w, http.StatusOK, replies)
+}
+
+// federateChirp queues Create, Update and Delete activities for a federated
+// user's chirps to their remote followers. Like emitEvent it is called where
+// the chirp changes, so the deliveries are stored before the request
+// finishes.
+func (cfg *apiConfig) federateChirp(eventType string, chirp database.Chirp) {
+	if cfg.BaseURL == "" {
+		return
+	}
+
+	author, err := cfg.DB.GetUser(chirp.Author_Id)
+
+	if err != nil || !federated(author) {
+		return
+	}
+
+	followers, err := cfg.DB.GetRemoteFollowers(author.Id)
+
+	if err != nil || len(followers) == 0 {
+		return
+	}
+
+	activity := Activity{}
+
+	switch eventType {
+	case "chirp.created":
+		activity = cfg.createActivity(chirp)
+	case "chirp.updated":
+		activity = cfg.updateActivity(chirp)
+	case "chirp.deleted":
+		activity = cfg.deleteActivity(database.Tombstone{
+			Chirp_Id:   chirp.Id,
+			Author_Id:  author.Id,
+			Deleted_At: time.Now().UTC(),
+		})
+	default:
+		return
+	}
+
+	err = cfg.queueActivity(author.Id, activity, followerInboxes(followers))
+
+	if err != nil {
+		log.Printf("Could not queue %s activity: %s", activity.Type, err)
+	}
+}
+
+// followerInboxes returns the inboxes to deliver to, one per server where
+// followers share an inbox.
+func followerInboxes(followers []database.RemoteFollower) []string {
+	inboxes := []string{}
+	seen := map[string]bool{}
+
+	for _, follower := range followers {
+		inbox := follower.Inbox
+
+		if follower.Shared_Inbox != "" {
+			inbox = follower.Shared_Inbox
+		}
+
+		if !seen[inbox] {
+			seen[inbox] = true
+			inboxes = append(inboxes, inbox)
+		}
+	}
+
+	return inboxes
+}
+
+func (cfg *apiConfig) queueActivity(actorId int, activity Activity, inboxes []string) error {
+	dat, err := json.Marshal(activity)
+
+	if err != nil {
+		return err
+	}
+
+	deliveries := make([]database.FederationDelivery, 0, len(inboxes))
+
+	for _, inbox := range inboxes {
+		deliveries = append(deliveries, database.FederationDelivery{
+			Actor_Id: actorId,
+			Inbox:    inbox,
+			Activity: dat,
+		})
+	}
+
+	err = cfg.DB.QueueFederationDeliveries(deliveries)
+
+	if err != nil {
+		return err
+	}
+
+	cfg.Federation.Wake()
+
+	return nil
+}
+
+// deliverActivities starts sending queued activities as they come due, like
+// deliverWebhooks, with the same retries and the same per-inbox
+// concurrency.
+func (cfg *apiConfig) deliverActivities(interval time.Duration) {
+	tick := time.Tick(interval)
+
+	for {
+		select {
+		case <-tick:
+		case <-cfg.Federation.wake:
+		}
+
+		deliveries, err := cfg.DB.GetFederationDeliveries()
+
+		if err != nil {
+			log.Printf("Could not load federation deliveries: %s", err)
+			continue
+		}
+
+		sort.Slice(deliveries, func(i, j int) bool {
+			return deliveries[i].Id < deliveries[j].Id
+		})
+
+		for _, delivery := range deliveries {
+			if delivery.Status != "pending" && delivery.Status != "retrying" {
+				continue
+			}
+
+			if delivery.Next_Attempt_At.After(time.Now()) || !cfg.Federation.claim(delivery) {
+				continue
+			}
+
+			go func(delivery database.FederationDelivery) {
+				cfg.attemptActivityDelivery(delivery)
+				cfg.Federation.release(delivery)
+				cfg.Federation.Wake()
+			}(delivery)
+		}
+	}
+}
+
+func (cfg *apiConfig) attemptActivityDelivery(delivery database.FederationDelivery) {
+	attempt := database.DeliveryAttempt{At: time.Now().UTC()}
+	key, err := cfg.actorKey(delivery.Actor_Id)
+
+	if err == nil {
+		attempt = cfg.Federation.send(cfg.actorUrl(delivery.Actor_Id)+"#main-key", key, delivery)
+	} else {
+		attempt.Error = err.Error()
+	}
+
+	status := "delivered"
+	nextAttemptAt := time.Time{}
+
+	if attempt.Error != "" {
+		status = "retrying"
+		nextAttemptAt = attempt.At.Add(deliveryRetryBase << delivery.Attempts)
+
+		if delivery.Attempts+1 >= maxDeliveryAttempts {
+			status = "dead"
+			nextAttemptAt = time.Time{}
+		}
+	}
+
+	err = cfg.DB.RecordFederationAttempt(delivery.Id, attempt, status, nextAttemptAt)
+
+	if err != nil {
+		log.Printf("Could not record federation delivery %d: %s", delivery.Id, err)
+	}
+}
+
+func (fed *federation) send(keyId string, actorKey database.ActorKey, delivery database.FederationDelivery) database.DeliveryAttempt {
+	start := time.Now().UTC()
+	attempt := database.DeliveryAttempt{At: start}
+
+	key, err := parsePrivateKey(actorKey.Private_Key_Pem)
+
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.Inbox, bytes.NewReader(delivery.Activity))
+
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	req.Header.Set("Content-Type", activityContentType)
+	req.Header.Set("User-Agent", "Chirpy-Federation")
+
+	err = signRequest(req, keyId, key, delivery.Activity)
+
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	resp, err := fed.client.Do(req)
+	attempt.Duration_Ms = time.Since(start).Milliseconds()
+
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	attempt.Status_Code = resp.StatusCode
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("inbox responded with %s", resp.Status)
+	}
+
+	return attempt
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+// feedSize is how many of the newest chirps a feed includes.
+const feedSize = 50
+
+// feed is what every format is rendered from. Its chirps are newest first.
+type feed struct {
+	title       string
+	description string
+	homeUrl     string
+	feedUrl     string
+	baseUrl     string
+	chirps      []database.Chirp
+	authors     map[int]string
+	updated     time.Time
+}
+
+type feedFormat struct {
+	contentType string
+	render      func(feed) ([]byte, error)
+}
+
+const (
+	rssContentType      = "application/rss+xml; charset=utf-8"
+	atomContentType     = "application/atom+xml; charset=utf-8"
+	jsonFeedContentType = "application/feed+json; charset=utf-8"
+)
+
+var feedFormats = map[string]feedFormat{
+	"rss":  {contentType: rssContentType, render: renderRSS},
+	"atom": {contentType: atomContentType, render: renderAtom},
+	"json": {contentType: jsonFeedContentType, render: renderJSONFeed},
+}
+
+// handlerUserFeed serves the user's chirps, as listed by GET
+// /api/chirps?author_id=, in the format.
+func (cfg *apiConfig) handlerUserFeed(format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := cfg.loadViewer(r)
+
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		id, err := strconv.Atoi(r.PathValue("id"))
+
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+			return
+		}
+
+		user, err := cfg.DB.GetUser(id)
+
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithError(w, http.StatusNotFound, "User not found")
+			return
+		}
+
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Could not retrieve user")
+			return
+		}
+
+		dbChirps, err := cfg.queryChirps(caller, strconv.Itoa(id))
+
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+			return
+		}
+
+		base := cfg.baseURL(r)
+		name := feedAuthorName(user)
+
+		cfg.serveFeed(w, r, format, feed{
+			title:       name + " on Chirpy",
+			description: "Chirps by " + name,
+			homeUrl:     fmt.Sprintf("%s/api/chirps?author_id=%d", base, id),
+			feedUrl:     base + r.URL.Path,
+			baseUrl:     base,
+			chirps:      dbChirps,
+		})
+	}
+}
+
+// handlerHashtagFeed serves the chirps with the hashtag, as listed by GET
+// /api/hashtags/{tag}/chirps, in the format.
+func (cfg *apiConfig) handlerHashtagFeed(format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := cfg.loadViewer(r)
+
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		tag := strings.ToLower(strings.TrimPrefix(r.PathValue("tag"), "#"))
+
+		dbChirps, err := cfg.queryHashtagChirps(caller, tag)
+
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+			return
+		}
+
+		base := cfg.baseURL(r)
+
+		cfg.serveFeed(w, r, format, feed{
+			title:       "#" + tag + " on Chirpy",
+			description: "Chirps tagged #" + tag,
+			homeUrl:     base + "/api/hashtags/" + url.PathEscape(tag) + "/chirps",
+			feedUrl:     base + r.URL.Path,
+			baseUrl:     base,
+			chirps:      dbChirps,
+		})
+	}
+}
+
+// serveFeed renders the newest chirps of f in the format. Its ETag is a hash
+// of the rendered feed and its Last-Modified the time the newest of its
+// chirps was last changed, so both change when a chirp is posted or edited.
+// Deleting a chirp only changes the ETag, which takes precedence when a
+// reader sends both.
+func (cfg *apiConfig) serveFeed(w http.ResponseWriter, r *http.Request, format string, f feed) {
+	sort.Slice(f.chirps, func(i, j int) bool {
+		return newestFirst(dbChirpCursor(f.chirps[i]), dbChirpCursor(f.chirps[j]))
+	})
+
+	if len(f.chirps) > feedSize {
+		f.chirps = f.chirps[:feedSize]
+	}
+
+	dbUsers, err := cfg.DB.GetUsers()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve users")
+		return
+	}
+
+	f.authors = map[int]string{}
+
+	for _, user := range dbUsers {
+		f.authors[user.Id] = feedAuthorName(user)
+	}
+
+	for _, chirp := range f.chirps {
+		if chirp.Updated_At.After(f.updated) {
+			f.updated = chirp.Updated_At
+		}
+	}
+
+	dat, err := feedFormats[format].render(f)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not render feed")
+		return
+	}
+
+	sum := sha256.Sum256(dat)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+
+	if !f.updated.IsZero() {
+		w.Header().Set("Last-Modified", f.updated.UTC().Format(http.TimeFormat))
+	}
+
+	if feedNotModified(r, etag, f.updated) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", feedFormats[format].contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(dat)
+}
+
+// feedNotModified reports whether the reader's copy is current. As in RFC
+// 9110, If-Modified-Since is ignored when If-None-Match is sent.
+func feedNotModified(r *http.Request, etag string, updated time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+
+	if err != nil || updated.IsZero() {
+		return false
+	}
+
+	return !updated.Truncate(time.Second).After(since)
+}
+
+func feedAuthorName(user database.User) string {
+	if user.Handle != "" {
+		return "@" + user.Handle
+	}
+
+	return fmt.Sprintf("User %d", user.Id)
+}
+
+func (f feed) chirpUrl(chirp database.Chirp) string {
+	return fmt.Sprintf("%s/api/chirps/%d", f.baseUrl, chirp.Id)
+}
+
+func (f feed) authorUrl(chirp database.Chirp) string {
+	return fmt.Sprintf("%s/api/chirps?author_id=%d", f.baseUrl, chirp.Author_Id)
+}
+
+func chirpHashtags(chirp database.Chirp) []string {
+	tags := []string{}
+
+	for _, entity := range chirp.Entities {
+		if entity.Type == "hashtag" {
+			tags = append(tags, entity.Value)
+		}
+	}
+
+	return tags
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Self          atomLink  `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	Guid        rssGuid  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func renderRSS(f feed) ([]byte, error) {
+	channel := rssChannel{
+		Title:       f.title,
+		Link:        f.homeUrl,
+		Description: f.description,
+		Self:        atomLink{Href: f.feedUrl, Rel: "self", Type: rssContentType},
+		Items:       []rssItem{},
+	}
+
+	if !f.updated.IsZero() {
+		channel.LastBuildDate = f.updated.UTC().Format(time.RFC1123Z)
+	}
+
+	for _, chirp := range f.chirps {
+		channel.Items = append(channel.Items, rssItem{
+			Link:        f.chirpUrl(chirp),
+			Description: chirp.Body,
+			Guid:        rssGuid{IsPermaLink: true, Value: f.chirpUrl(chirp)},
+			PubDate:     chirp.Created_At.UTC().Format(time.RFC1123Z),
+			Categories:  chirpHashtags(chirp),
+		})
+	}
+
+	return marshalFeedXML(rssFeed{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: channel,
+	})
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Id         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Link       atomLink       `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Author     atomPerson     `xml:"author"`
+	Content    atomContent    `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	Uri  string `xml:"uri,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func renderAtom(f feed) ([]byte, error) {
+	// Atom requires a feed to say when it was updated, even with no entries.
+	updated := f.updated
+
+	if updated.IsZero() {
+		updated = time.Unix(0, 0)
+	}
+
+	atom := atomFeed{
+		Id:       f.feedUrl,
+		Title:    f.title,
+		Subtitle: f.description,
+		Updated:  updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.feedUrl, Rel: "self", Type: atomContentType},
+			{Href: f.homeUrl, Rel: "alternate", Type: "application/json"},
+		},
+		Entries: []atomEntry{},
+	}
+
+	for _, chirp := range f.chirps {
+		categories := []atomCategory{}
+
+		for _, tag := range chirpHashtags(chirp) {
+			categories = append(categories, atomCategory{Term: tag})
+		}
+
+		atom.Entries = append(atom.Entries, atomEntry{
+			Id:         f.chirpUrl(chirp),
+			Title:      chirp.Body,
+			Link:       atomLink{Href: f.chirpUrl(chirp), Rel: "alternate"},
+			Published:  chirp.Created_At.UTC().Format(time.RFC3339),
+			Updated:    chirp.Updated_At.UTC().Format(time.RFC3339),
+			Author:     atomPerson{Name: f.authors[chirp.Author_Id], Uri: f.authorUrl(chirp)},
+			Content:    atomContent{Type: "text", Body: chirp.Body},
+			Categories: categories,
+		})
+	}
+
+	return marshalFeedXML(atom)
+}
+
+func marshalFeedXML(v interface{}) ([]byte, error) {
+	dat, err := xml.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), dat...), nil
+}
+
+type jsonFeed struct {
+	Version       string         `json:"version"`
+	Title         string         `json:"title"`
+	Home_Page_Url string         `json:"home_page_url"`
+	Feed_Url      string         `json:"feed_url"`
+	Description   string         `json:"description"`
+	Items         []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	Id             string           `json:"id"`
+	Url            string           `json:"url"`
+	Content_Text   string           `json:"content_text"`
+	Date_Published time.Time        `json:"date_published"`
+	Date_Modified  time.Time        `json:"date_modified"`
+	Authors        []jsonFeedAuthor `json:"authors"`
+	Tags           []string         `json:"tags,omitempty"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	Url  string `json:"url,omitempty"`
+}
+
+func renderJSONFeed(f feed) ([]byte, error) {
+	jf := jsonFeed{
+		Version:       "https://jsonfeed.org/version/1.1",
+		Title:         f.title,
+		Home_Page_Url: f.homeUrl,
+		Feed_Url:      f.feedUrl,
+		Description:   f.description,
+		Items:         []jsonFeedItem{},
+	}
+
+	for _, chirp := range f.chirps {
+		jf.Items = append(jf.Items, jsonFeedItem{
+			Id:             strconv.Itoa(chirp.Id),
+			Url:            f.chirpUrl(chirp),
+			Content_Text:   chirp.Body,
+			Date_Published: chirp.Created_At.UTC(),
+			Date_Modified:  chirp.Updated_At.UTC(),
+			Authors:        []jsonFeedAuthor{{Name: f.authors[chirp.Author_Id], Url: f.authorUrl(chirp)}},
+			Tags:           chirpHashtags(chirp),
+		})
+	}
+
+	return json.MarshalIndent(jf, "", "  ")
+}
+
+// baseURL is the configured BASE_URL, or else the scheme and host the request
+// was made to.
+func (cfg *apiConfig) baseURL(r *http.Request) string {
+	if cfg.BaseURL != "" {
+		return cfg.BaseURL
+	}
+
+	scheme := "http"
+
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+
+	return scheme + "://" + r.Host
+}
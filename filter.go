@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const filterReplacement = "****"
+
+var filterActions = []string{"mask", "reject", "flag"}
+
+var defaultFilterRules = []filterRule{
+	{Word: "kerfuffle", Action: "mask"},
+	{Word: "sharbert", Action: "mask"},
+	{Word: "fornax", Action: "mask"},
+}
+
+type filterRule struct {
+	Word   string `json:"word"`
+	Action string `json:"action"`
+}
+
+type filterResult struct {
+	Body     string
+	Rejected bool
+	Flagged  []string
+}
+
+// contentFilter matches chirp words against a rule list loaded from a JSON
+// file. Words are compared after folding case, accents, common Unicode
+// look-alikes and leetspeak, so "K3rfüffle!" still matches "kerfuffle".
+type contentFilter struct {
+	mux   *sync.RWMutex
+	path  string
+	rules map[string]filterRule
+}
+
+func newContentFilter(path string) (*contentFilter, error) {
+	filter := &contentFilter{
+		mux:   &sync.RWMutex{},
+		path:  path,
+		rules: map[string]filterRule{},
+	}
+
+	for _, rule := range defaultFilterRules {
+		filter.rules[rule.Word] = rule
+	}
+
+	err := filter.Reload()
+
+	if errors.Is(err, os.ErrNotExist) {
+		return filter, nil
+	}
+
+	return filter, err
+}
+
+func (filter *contentFilter) Reload() error {
+	dat, err := os.ReadFile(filter.path)
+
+	if err != nil {
+		return err
+	}
+
+	loaded := []filterRule{}
+	err = json.Unmarshal(dat, &loaded)
+
+	if err != nil {
+		return err
+	}
+
+	rules := map[string]filterRule{}
+
+	for _, rule := range loaded {
+		rule, err = validateFilterRule(rule)
+
+		if err != nil {
+			return err
+		}
+
+		rules[rule.Word] = rule
+	}
+
+	filter.mux.Lock()
+	defer filter.mux.Unlock()
+
+	filter.rules = rules
+
+	return nil
+}
+
+func (filter *contentFilter) Rules() []filterRule {
+	filter.mux.RLock()
+	defer filter.mux.RUnlock()
+
+	rules := make([]filterRule, 0, len(filter.rules))
+
+	for _, rule := range filter.rules {
+		rules = append(rules, rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Word < rules[j].Word
+	})
+
+	return rules
+}
+
+func (filter *contentFilter) SetRule(rule filterRule) error {
+	return filter.modify(func(rules map[string]filterRule) {
+		rules[rule.Word] = rule
+	})
+}
+
+func (filter *contentFilter) DeleteRule(word string) error {
+	return filter.modify(func(rules map[string]filterRule) {
+		delete(rules, normalizeFilterWord(word))
+	})
+}
+
+// modify applies change to a copy of the rules and persists it before
+// swapping it in, so a failed write leaves the filter unchanged.
+func (filter *contentFilter) modify(change func(map[string]filterRule)) error {
+	filter.mux.Lock()
+	defer filter.mux.Unlock()
+
+	rules := make(map[string]filterRule, len(filter.rules))
+
+	for word, rule := range filter.rules {
+		rules[word] = rule
+	}
+
+	change(rules)
+
+	ruleList := make([]filterRule, 0, len(rules))
+
+	for _, rule := range rules {
+		ruleList = append(ruleList, rule)
+	}
+
+	sort.Slice(ruleList, func(i, j int) bool {
+		return ruleList[i].Word < ruleList[j].Word
+	})
+
+	dat, err := json.MarshalIndent(ruleList, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filter.path + ".tmp"
+	err = os.WriteFile(tmpPath, dat, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, filter.path)
+
+	if err != nil {
+		return err
+	}
+
+	filter.rules = rules
+
+	return nil
+}
+
+// Apply masks, rejects or flags body according to the matching rules. When
+// several rules match, reject wins; masked words are replaced in place.
+func (filter *contentFilter) Apply(body string) filterResult {
+	filter.mux.RLock()
+	defer filter.mux.RUnlock()
+
+	result := filterResult{}
+	builder := strings.Builder{}
+	last := 0
+
+	for _, span := range filterWordSpans(body) {
+		rule, ok := filter.match(body[span[0]:span[1]])
+
+		if !ok {
+			continue
+		}
+
+		switch rule.Action {
+		case "reject":
+			result.Rejected = true
+		case "flag":
+			result.Flagged = append(result.Flagged, rule.Word)
+		case "mask":
+			builder.WriteString(body[last:span[0]])
+			builder.WriteString(filterReplacement)
+			last = span[1]
+		}
+	}
+
+	builder.WriteString(body[last:])
+	result.Body = builder.String()
+
+	return result
+}
+
+func (filter *contentFilter) match(word string) (filterRule, bool) {
+	for _, candidate := range filterCandidates(word) {
+		if rule, ok := filter.rules[candidate]; ok {
+			return rule, true
+		}
+	}
+
+	return filterRule{}, false
+}
+
+// filterWordSpans returns the byte spans of the words in body. Punctuation
+// and whitespace separate words, except for the symbols used in leetspeak.
+func filterWordSpans(body string) [][2]int {
+	spans := [][2]int{}
+	start := -1
+
+	for i, r := range body {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || strings.ContainsRune("@$", r)
+
+		if inWord && start == -1 {
+			start = i
+		}
+
+		if !inWord && start != -1 {
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+
+	if start != -1 {
+		spans = append(spans, [2]int{start, len(body)})
+	}
+
+	return spans
+}
+
+var confusables = map[rune]rune{
+	'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's', 'к': 'k', 'в': 'b', 'н': 'h', 'т': 't', 'м': 'm',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+}
+
+var leetspeak = map[rune]rune{
+	'0': 'o', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '@': 'a', '$': 's',
+}
+
+// normalizeFilterWord folds compatibility forms (such as full-width letters),
+// strips accents, maps look-alike letters from other scripts to Latin and
+// lowercases.
+func normalizeFilterWord(word string) string {
+	builder := strings.Builder{}
+
+	for _, r := range norm.NFKD.String(strings.ToLower(word)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+
+		if replacement, ok := confusables[r]; ok {
+			r = replacement
+		}
+
+		builder.WriteRune(r)
+	}
+
+	return builder.String()
+}
+
+// filterCandidates returns the normalized word, and the word with leetspeak
+// decoded, reading 1 as both i and l. A leading @ is also tried without it,
+// so mentions of a filtered word still match.
+func filterCandidates(word string) []string {
+	candidates := []string{}
+
+	for _, variant := range []string{word, strings.TrimLeft(word, "@")} {
+		normalized := normalizeFilterWord(variant)
+		candidates = append(candidates, normalized, decodeLeetspeak(normalized, 'i'))
+
+		if strings.ContainsRune(normalized, '1') {
+			candidates = append(candidates, decodeLeetspeak(normalized, 'l'))
+		}
+	}
+
+	return candidates
+}
+
+func decodeLeetspeak(word string, one rune) string {
+	return strings.Map(func(r rune) rune {
+		if r == '1' {
+			return one
+		}
+
+		if replacement, ok := leetspeak[r]; ok {
+			return replacement
+		}
+
+		return r
+	}, word)
+}
+
+func validateFilterRule(rule filterRule) (filterRule, error) {
+	rule.Word = normalizeFilterWord(strings.TrimSpace(rule.Word))
+
+	if rule.Word == "" || strings.ContainsFunc(rule.Word, unicode.IsSpace) {
+		return rule, errors.New("filter word must be a single word")
+	}
+
+	for _, action := range filterActions {
+		if rule.Action == action {
+			return rule, nil
+		}
+	}
+
+	return rule, fmt.Errorf("filter action must be one of %s", strings.Join(filterActions, ", "))
+}
+
+// watchFile calls reload whenever the modification time of path changes,
+// checking every interval. It never returns.
+func watchFile(path string, interval time.Duration, reload func() error) {
+	lastModified := time.Time{}
+
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+
+		if err != nil || info.ModTime().Equal(lastModified) {
+			continue
+		}
+
+		lastModified = info.ModTime()
+
+		err = reload()
+
+		if err != nil {
+			log.Printf("Could not reload %s: %s", path, err)
+			continue
+		}
+
+		log.Printf("Reloaded %s", path)
+	}
+}
+
+func (cfg *apiConfig) handlerGetFilters(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, cfg.Filter.Rules())
+}
+
+func (cfg *apiConfig) handlerSetFilter(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	rule := filterRule{}
+	err := decoder.Decode(&rule)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	rule, err = validateFilterRule(rule)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = cfg.Filter.SetRule(rule)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not save filter rules")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, rule)
+}
+
+func (cfg *apiConfig) handlerDeleteFilter(w http.ResponseWriter, r *http.Request) {
+	err := cfg.Filter.DeleteRule(r.PathValue("word"))
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not save filter rules")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+func (cfg *apiConfig) handlerReloadFilters(w http.ResponseWriter, r *http.Request) {
+	err := cfg.Filter.Reload()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Could not reload filter rules: %v", err))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.Filter.Rules())
+}
@@ -7,4 +7,10 @@ require (
 	golang.org/x/crypto v0.7.0
 )
 
-require github.com/golang-jwt/jwt/v5 v5.2.1
+require (
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/rivo/uniseg v0.4.7
+	golang.org/x/text v0.14.0
+)
+
+require github.com/gorilla/websocket v1.5.0
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// signatureMaxSkew is how far a signed request's Date may be from now.
+const signatureMaxSkew = time.Hour
+
+// signedHeaders are the headers we sign and require others to sign, as
+// Mastodon does. Digest is only required when there is a body.
+var signedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// signRequest signs req as keyId with the draft-cavage HTTP Signatures
+// scheme the fediverse uses, setting its Date and, for requests with a body,
+// Digest headers.
+func signRequest(req *http.Request, keyId string, key *rsa.PrivateKey, body []byte) error {
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := signedHeaders[:3]
+
+	if body != nil {
+		req.Header.Set("Digest", bodyDigest(body))
+		headers = signedHeaders
+	}
+
+	hashed := sha256.Sum256([]byte(signingString(req, headers)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyId, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+
+	return nil
+}
+
+type requestSignature struct {
+	keyId     string
+	headers   []string
+	signature []byte
+}
+
+// parseSignature reads the request's Signature header and checks that it
+// covers the headers we require and that its Date and Digest are current.
+func parseSignature(r *http.Request, body []byte) (requestSignature, error) {
+	sig := requestSignature{}
+	header := r.Header.Get("Signature")
+
+	if header == "" {
+		return sig, errors.New("request is not signed")
+	}
+
+	params := map[string]string{}
+
+	for _, param := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+
+		if ok {
+			params[name] = strings.Trim(value, `"`)
+		}
+	}
+
+	if algorithm := params["algorithm"]; algorithm != "" && algorithm != "rsa-sha256" && algorithm != "hs2019" {
+		return sig, errors.New("unsupported signature algorithm")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+
+	if err != nil || params["keyId"] == "" {
+		return sig, errors.New("malformed signature")
+	}
+
+	sig.keyId = params["keyId"]
+	sig.signature = signature
+	sig.headers = strings.Fields(strings.ToLower(params["headers"]))
+
+	required := signedHeaders[:3]
+
+	if len(body) > 0 {
+		required = signedHeaders
+	}
+
+	for _, name := range required {
+		if !slices.Contains(sig.headers, name) {
+			return sig, fmt.Errorf("signature must cover %s", name)
+		}
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+
+	if err != nil {
+		return sig, errors.New("malformed date")
+	}
+
+	if skew := time.Since(date); skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return sig, errors.New("date is too far from now")
+	}
+
+	if len(body) > 0 && !digestMatches(r.Header.Get("Digest"), body) {
+		return sig, errors.New("digest does not match body")
+	}
+
+	return sig, nil
+}
+
+// digestMatches reports whether the Digest header has a SHA-256 digest of
+// body. Servers differ in how they write the algorithm's name.
+func digestMatches(header string, body []byte) bool {
+	_, want, _ := strings.Cut(bodyDigest(body), "=")
+
+	for _, digest := range strings.Split(header, ",") {
+		algorithm, value, _ := strings.Cut(strings.TrimSpace(digest), "=")
+
+		if strings.EqualFold(algorithm, "SHA-256") && value == want {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (sig requestSignature) verify(r *http.Request, key *rsa.PublicKey) error {
+	hashed := sha256.Sum256([]byte(signingString(r, sig.headers)))
+
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig.signature)
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, 0, len(headers))
+
+	for _, name := range headers {
+		value := ""
+
+		switch name {
+		case "(request-target)":
+			value = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			value = r.Host
+		default:
+			value = strings.Join(r.Header.Values(name), ", ")
+		}
+
+		lines = append(lines, name+": "+value)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func generateKeyPair() (privatePem, publicPem string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	privateDer, err := x509.MarshalPKCS8PrivateKey(key)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	publicDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	privatePem = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer}))
+	publicPem = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}))
+
+	return privatePem, publicPem, nil
+}
+
+func parsePrivateKey(privatePem string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privatePem))
+
+	if block == nil {
+		return nil, errors.New("malformed private key")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, errors.New("private key is not RSA")
+	}
+
+	return rsaKey, nil
+}
+
+// parsePublicKey reads a PEM public key in either the PKIX form most servers
+// publish or the PKCS #1 form some older ones do.
+func parsePublicKey(publicPem string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicPem))
+
+	if block == nil {
+		return nil, errors.New("malformed public key")
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+
+	if !ok {
+		return nil, errors.New("public key is not RSA")
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+// hubSubscriberBufferSize is how many messages a subscriber can fall behind
+// by before the hub drops it.
+const hubSubscriberBufferSize = 256
+
+// hubMessage is published to a topic. Topics are "user:<id>" for chirps by a
+// user, "hashtag:<tag>" for chirps with a hashtag and "notifications:<id>"
+// for a user's notifications.
+type hubMessage struct {
+	Topic string
+	Type  string
+	Data  interface{}
+	// Author_Id is the user the message is about, so subscribers can skip
+	// messages from users they cannot see. It is 0 for notifications.
+	Author_Id int
+}
+
+// hub fans published messages out to the subscribers of their topic.
+type hub struct {
+	mux    *sync.Mutex
+	topics map[string]map[*hubSubscription]bool
+}
+
+// hubSubscription receives messages for its topics on C. The hub closes C
+// when the subscriber falls too far behind.
+type hubSubscription struct {
+	C      <-chan hubMessage
+	c      chan hubMessage
+	topics map[string]bool
+	closed bool
+}
+
+func newHub() *hub {
+	return &hub{
+		mux:    &sync.Mutex{},
+		topics: map[string]map[*hubSubscription]bool{},
+	}
+}
+
+func (h *hub) Connect() *hubSubscription {
+	c := make(chan hubMessage, hubSubscriberBufferSize)
+
+	return &hubSubscription{C: c, c: c, topics: map[string]bool{}}
+}
+
+func (h *hub) Subscribe(sub *hubSubscription, topics ...string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if sub.closed {
+		return
+	}
+
+	for _, topic := range topics {
+		if h.topics[topic] == nil {
+			h.topics[topic] = map[*hubSubscription]bool{}
+		}
+
+		h.topics[topic][sub] = true
+		sub.topics[topic] = true
+	}
+}
+
+func (h *hub) Unsubscribe(sub *hubSubscription, topics ...string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.unsubscribeLocked(sub, topics...)
+}
+
+func (h *hub) unsubscribeLocked(sub *hubSubscription, topics ...string) {
+	for _, topic := range topics {
+		delete(h.topics[topic], sub)
+		delete(sub.topics, topic)
+
+		if len(h.topics[topic]) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+}
+
+func (h *hub) Disconnect(sub *hubSubscription) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.disconnectLocked(sub)
+}
+
+func (h *hub) disconnectLocked(sub *hubSubscription) {
+	if sub.closed {
+		return
+	}
+
+	for topic := range sub.topics {
+		h.unsubscribeLocked(sub, topic)
+	}
+
+	sub.closed = true
+	close(sub.c)
+}
+
+// Publish never blocks. Subscribers whose buffer is full are disconnected
+// rather than holding up the publisher and everyone else.
+func (h *hub) Publish(message hubMessage) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	for sub := range h.topics[message.Topic] {
+		select {
+		case sub.c <- message:
+		default:
+			h.disconnectLocked(sub)
+		}
+	}
+}
+
+// relayChirpEvents publishes the database's chirp events to the hub, to the
+// author's topic and the topic of each hashtag. It never returns.
+func (cfg *apiConfig) relayChirpEvents() {
+	cfg.consumeChirpEvents(cfg.publishChirpEvent)
+}
+
+// consumeChirpEvents calls handle with each of the database's chirp events in
+// order. If it falls behind it resumes from the last event it handled. It
+// never returns.
+func (cfg *apiConfig) consumeChirpEvents(handle func(database.ChirpEvent)) {
+	sub := cfg.DB.ChirpEvents().Subscribe()
+	lastId := sub.After
+
+	for {
+		for event := range sub.C {
+			handle(event)
+			lastId = event.Id
+		}
+
+		missed, complete, resumed := cfg.DB.ChirpEvents().Resume(lastId)
+
+		if !complete {
+			log.Printf("Chirp events after %d were dropped before they could be handled", lastId)
+		}
+
+		for _, event := range missed {
+			handle(event)
+			lastId = event.Id
+		}
+
+		sub = resumed
+	}
+}
+
+func (cfg *apiConfig) publishChirpEvent(event database.ChirpEvent) {
+	data := chirpEventData(event)
+	topics := []string{fmt.Sprintf("user:%d", event.Chirp.Author_Id)}
+
+	for _, entity := range event.Chirp.Entities {
+		if entity.Type == "hashtag" {
+			topics = append(topics, "hashtag:"+entity.Value)
+		}
+	}
+
+	for _, topic := range topics {
+		cfg.Hub.Publish(hubMessage{
+			Topic:     topic,
+			Type:      event.Type,
+			Data:      data,
+			Author_Id: event.Chirp.Author_Id,
+		})
+	}
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const (
+	chirpyEventHeader     = "X-Chirpy-Event"
+	chirpyDeliveryHeader  = "X-Chirpy-Delivery"
+	chirpyTimestampHeader = "X-Chirpy-Timestamp"
+	chirpySignatureHeader = "X-Chirpy-Signature"
+
+	maxWebhookEndpoints = 10
+	maxDeliveryAttempts = 8
+	deliveryRetryBase   = 30 * time.Second
+	deliveryTimeout     = 10 * time.Second
+	// Each endpoint gets at most deliveryWorkersPerEndpoint concurrent
+	// requests, out of maxDeliveryWorkers overall, so a slow receiver only
+	// holds up its own deliveries.
+	deliveryWorkersPerEndpoint = 2
+	maxDeliveryWorkers         = 32
+	// Delivered and dead deliveries are kept this long for their logs.
+	deliveryRetention = 7 * 24 * time.Hour
+)
+
+var webhookEventTypes = []string{"chirp.created", "chirp.updated", "chirp.deleted", "user.followed", "mention"}
+
+// WebhookEndpoint is the view of an endpoint shown to its owner. The signing
+// secret is only shown when the endpoint is created.
+type WebhookEndpoint struct {
+	Id         int       `json:"id"`
+	Url        string    `json:"url"`
+	Events     []string  `json:"events"`
+	Firehose   bool      `json:"firehose"`
+	Created_At time.Time `json:"created_at"`
+	Secret     string    `json:"secret,omitempty"`
+}
+
+type webhookEnvelope struct {
+	Id         string      `json:"id"`
+	Type       string      `json:"type"`
+	Created_At time.Time   `json:"created_at"`
+	Data       interface{} `json:"data"`
+}
+
+// webhookDispatcher sends queued deliveries. Queueing wakes it so new events
+// go out straight away rather than on the next tick. inFlight holds the ids
+// of deliveries being sent and busy the number of requests per endpoint.
+type webhookDispatcher struct {
+	client   *http.Client
+	wake     chan struct{}
+	mux      *sync.Mutex
+	inFlight map[int]bool
+	busy     map[int]int
+}
+
+func newWebhookDispatcher() *webhookDispatcher {
+	return &webhookDispatcher{
+		client:   newPublicClient(deliveryTimeout),
+		wake:     make(chan struct{}, 1),
+		mux:      &sync.Mutex{},
+		inFlight: map[int]bool{},
+		busy:     map[int]int{},
+	}
+}
+
+// claim reserves a worker for the delivery, failing when it is already being
+// sent or its endpoint or the dispatcher has no worker free.
+func (dispatcher *webhookDispatcher) claim(delivery database.WebhookDelivery) bool {
+	dispatcher.mux.Lock()
+	defer dispatcher.mux.Unlock()
+
+	if dispatcher.inFlight[delivery.Id] || len(dispatcher.inFlight) >= maxDeliveryWorkers ||
+		dispatcher.busy[delivery.Endpoint_Id] >= deliveryWorkersPerEndpoint {
+		return false
+	}
+
+	dispatcher.inFlight[delivery.Id] = true
+	dispatcher.busy[delivery.Endpoint_Id]++
+
+	return true
+}
+
+func (dispatcher *webhookDispatcher) release(delivery database.WebhookDelivery) {
+	dispatcher.mux.Lock()
+	defer dispatcher.mux.Unlock()
+
+	delete(dispatcher.inFlight, delivery.Id)
+	dispatcher.busy[delivery.Endpoint_Id]--
+
+	if dispatcher.busy[delivery.Endpoint_Id] == 0 {
+		delete(dispatcher.busy, delivery.Endpoint_Id)
+	}
+}
+
+func (dispatcher *webhookDispatcher) Wake() {
+	select {
+	case dispatcher.wake <- struct{}{}:
+	default:
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<body>", the
+// scheme used both for webhooks we send and for those Polka sends us.
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func endpointFromDB(endpoint database.WebhookEndpoint) WebhookEndpoint {
+	return WebhookEndpoint{
+		Id:         endpoint.Id,
+		Url:        endpoint.Url,
+		Events:     endpoint.Events,
+		Firehose:   endpoint.Firehose,
+		Created_At: endpoint.Created_At,
+	}
+}
+
+// emitEvent queues eventType for every endpoint subscribed to it that either
+// belongs to one of subjectIds, the users the event is about, or is an
+// admin's firehose. Failures are logged, as the action that caused the event
+// has already happened.
+func (cfg *apiConfig) emitEvent(eventType string, subjectIds []int, data interface{}) {
+	err := cfg.queueEvent(eventType, subjectIds, data)
+
+	if err != nil {
+		log.Printf("Could not queue %s webhooks: %s", eventType, err)
+	}
+}
+
+func (cfg *apiConfig) queueEvent(eventType string, subjectIds []int, data interface{}) error {
+	endpoints, err := cfg.DB.GetWebhookEndpoints()
+
+	if err != nil {
+		return err
+	}
+
+	subscribed := []database.WebhookEndpoint{}
+
+	for _, endpoint := range endpoints {
+		if !slices.Contains(endpoint.Events, eventType) {
+			continue
+		}
+
+		if endpoint.Firehose {
+			owner, err := cfg.DB.GetUser(endpoint.Owner_Id)
+
+			if err == nil && hasRole(owner, roleAdmin) {
+				subscribed = append(subscribed, endpoint)
+			}
+
+			continue
+		}
+
+		if slices.Contains(subjectIds, endpoint.Owner_Id) {
+			subscribed = append(subscribed, endpoint)
+		}
+	}
+
+	if len(subscribed) == 0 {
+		return nil
+	}
+
+	randomBytes := make([]byte, 16)
+	_, err = rand.Read(randomBytes)
+
+	if err != nil {
+		return err
+	}
+
+	eventId := "evt_" + hex.EncodeToString(randomBytes)
+
+	payload, err := json.Marshal(webhookEnvelope{
+		Id:         eventId,
+		Type:       eventType,
+		Created_At: time.Now().UTC(),
+		Data:       data,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	deliveries := make([]database.WebhookDelivery, 0, len(subscribed))
+
+	for _, endpoint := range subscribed {
+		deliveries = append(deliveries, database.WebhookDelivery{
+			Endpoint_Id: endpoint.Id,
+			Event_Id:    eventId,
+			Event:       eventType,
+			Payload:     payload,
+		})
+	}
+
+	_, err = cfg.DB.QueueWebhookDeliveries(deliveries)
+
+	if err != nil {
+		return err
+	}
+
+	cfg.Webhooks.Wake()
+
+	return nil
+}
+
+type chirpDeletedData struct {
+	Chirp_Id  int `json:"chirp_id"`
+	Author_Id int `json:"author_id"`
+}
+
+type userFollowedData struct {
+	Follower_Id int `json:"follower_id"`
+	Followed_Id int `json:"followed_id"`
+}
+
+type mentionData struct {
+	User_Id int            `json:"user_id"`
+	Chirp   database.Chirp `json:"chirp"`
+}
+
+func (cfg *apiConfig) emitChirpDeleted(chirp database.Chirp) {
+	cfg.emitEvent("chirp.deleted", []int{chirp.Author_Id}, chirpDeletedData{
+		Chirp_Id:  chirp.Id,
+		Author_Id: chirp.Author_Id,
+	})
+}
+
+// deliverWebhooks starts sending due deliveries whenever it is woken and at
+// least every interval, and prunes old ones on each tick. A delivery
+// interrupted by a restart is still pending and is sent again, so receivers
+// should use the event id to drop duplicates. It never returns.
+func (cfg *apiConfig) deliverWebhooks(interval time.Duration) {
+	tick := time.Tick(interval)
+
+	for {
+		select {
+		case <-tick:
+			err := cfg.DB.PruneWebhookDeliveries(time.Now().UTC().Add(-deliveryRetention))
+
+			if err != nil {
+				log.Printf("Could not prune webhook deliveries: %s", err)
+			}
+		case <-cfg.Webhooks.wake:
+		}
+
+		deliveries, err := cfg.DB.GetWebhookDeliveries()
+
+		if err != nil {
+			log.Printf("Could not load webhook deliveries: %s", err)
+			continue
+		}
+
+		sort.Slice(deliveries, func(i, j int) bool {
+			return deliveries[i].Id < deliveries[j].Id
+		})
+
+		for _, delivery := range deliveries {
+			if delivery.Status != "pending" && delivery.Status != "retrying" {
+				continue
+			}
+
+			if delivery.Next_Attempt_At.After(time.Now()) || !cfg.Webhooks.claim(delivery) {
+				continue
+			}
+
+			go func(delivery database.WebhookDelivery) {
+				cfg.attemptDelivery(delivery)
+				cfg.Webhooks.release(delivery)
+				cfg.Webhooks.Wake()
+			}(delivery)
+		}
+	}
+}
+
+// attemptDelivery sends the delivery once and records the attempt. Failed
+// deliveries are retried with exponential backoff from deliveryRetryBase
+// and moved to the dead letter list after maxDeliveryAttempts.
+func (cfg *apiConfig) attemptDelivery(delivery database.WebhookDelivery) {
+	endpoint, err := cfg.DB.GetWebhookEndpoint(delivery.Endpoint_Id)
+
+	if err != nil {
+		return
+	}
+
+	attempt := cfg.Webhooks.send(endpoint, delivery)
+
+	status := "delivered"
+	nextAttemptAt := time.Time{}
+
+	if attempt.Error != "" {
+		status = "retrying"
+		nextAttemptAt = attempt.At.Add(deliveryRetryBase << delivery.Attempts)
+
+		if delivery.Attempts+1 >= maxDeliveryAttempts {
+			status = "dead"
+			nextAttemptAt = time.Time{}
+		}
+	}
+
+	_, err = cfg.DB.RecordWebhookAttempt(delivery.Id, attempt, status, nextAttemptAt)
+
+	if err != nil {
+		log.Printf("Could not record webhook delivery %d: %s", delivery.Id, err)
+	}
+}
+
+func (dispatcher *webhookDispatcher) send(endpoint database.WebhookEndpoint, delivery database.WebhookDelivery) database.DeliveryAttempt {
+	start := time.Now().UTC()
+	attempt := database.DeliveryAttempt{At: start}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint.Url, bytes.NewReader(delivery.Payload))
+
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Chirpy-Webhooks")
+	req.Header.Set(chirpyEventHeader, delivery.Event)
+	req.Header.Set(chirpyDeliveryHeader, strconv.Itoa(delivery.Id))
+	req.Header.Set(chirpyTimestampHeader, timestamp)
+	req.Header.Set(chirpySignatureHeader, "v1="+signWebhook([]byte(endpoint.Secret), timestamp, delivery.Payload))
+
+	resp, err := dispatcher.client.Do(req)
+	attempt.Duration_Ms = time.Since(start).Milliseconds()
+
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	attempt.Status_Code = resp.StatusCode
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("endpoint responded with %s", resp.Status)
+	}
+
+	return attempt
+}
+
+// validateWebhookUrl checks that rawUrl is an http or https URL on a public
+// host. Deliveries are checked again when they connect.
+func validateWebhookUrl(rawUrl string) error {
+	parsed, err := url.Parse(rawUrl)
+
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+
+	return checkPublicHost(ctx, parsed)
+}
+
+// validateWebhookEvents returns events without duplicates, or an error if
+// any of them is not an event we send.
+func validateWebhookEvents(events []string) ([]string, error) {
+	valid := []string{}
+
+	for _, event := range events {
+		if !slices.Contains(webhookEventTypes, event) {
+			return nil, fmt.Errorf("events must be from %s", strings.Join(webhookEventTypes, ", "))
+		}
+
+		if !slices.Contains(valid, event) {
+			valid = append(valid, event)
+		}
+	}
+
+	if len(valid) == 0 {
+		return nil, errors.New("at least one event is required")
+	}
+
+	return valid, nil
+}
+
+func (cfg *apiConfig) handlerCreateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Url      string   `json:"url"`
+		Events   []string `json:"events"`
+		Firehose bool     `json:"firehose"`
+	}
+
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if !cfg.requireActive(w, userId) {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	err = validateWebhookUrl(params.Url)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	events, err := validateWebhookEvents(params.Events)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if params.Firehose {
+		user, err := cfg.DB.GetUser(userId)
+
+		if err != nil || !hasRole(user, roleAdmin) {
+			respondWithError(w, http.StatusForbidden, "Only admins can receive every event")
+			return
+		}
+	}
+
+	owned, err := cfg.ownedWebhookEndpoints(userId)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook endpoints")
+		return
+	}
+
+	if len(owned) >= maxWebhookEndpoints {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("You can register at most %d webhook endpoints", maxWebhookEndpoints))
+		return
+	}
+
+	secretBytes := make([]byte, 32)
+	_, err = rand.Read(secretBytes)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not create webhook endpoint")
+		return
+	}
+
+	endpoint, err := cfg.DB.CreateWebhookEndpoint(database.WebhookEndpoint{
+		Owner_Id: userId,
+		Url:      params.Url,
+		Secret:   "whsec_" + hex.EncodeToString(secretBytes),
+		Events:   events,
+		Firehose: params.Firehose,
+	})
+	cfg.audit(r, userId, "webhook_endpoint.create", auditTarget("webhook_endpoint", endpoint.Id), auditOutcome(err))
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not create webhook endpoint")
+		return
+	}
+
+	created := endpointFromDB(endpoint)
+	created.Secret = endpoint.Secret
+
+	respondWithJSON(w, http.StatusCreated, created)
+}
+
+func (cfg *apiConfig) handlerGetWebhookEndpoints(w http.ResponseWriter, r *http.Request) {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	owned, err := cfg.ownedWebhookEndpoints(userId)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook endpoints")
+		return
+	}
+
+	endpoints := make([]WebhookEndpoint, 0, len(owned))
+
+	for _, endpoint := range owned {
+		endpoints = append(endpoints, endpointFromDB(endpoint))
+	}
+
+	respondWithJSON(w, http.StatusOK, endpoints)
+}
+
+func (cfg *apiConfig) handlerDeleteWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := cfg.loadOwnedEndpoint(w, r)
+
+	if !ok {
+		return
+	}
+
+	err := cfg.DB.DeleteWebhookEndpoint(endpoint.Id)
+	cfg.audit(r, endpoint.Owner_Id, "webhook_endpoint.delete", auditTarget("webhook_endpoint", endpoint.Id), auditOutcome(err))
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not delete webhook endpoint")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// handlerGetWebhookDeliveries is the delivery log of an endpoint, newest
+// first, optionally filtered by status and event. Deliveries that ran out of
+// attempts have status dead.
+func (cfg *apiConfig) handlerGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := cfg.loadOwnedEndpoint(w, r)
+
+	if !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	eventType := r.URL.Query().Get("event")
+
+	page, err := parsePageRequest(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbDeliveries, err := cfg.DB.GetWebhookDeliveries()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook deliveries")
+		return
+	}
+
+	deliveries := []database.WebhookDelivery{}
+
+	for _, delivery := range dbDeliveries {
+		if delivery.Endpoint_Id != endpoint.Id {
+			continue
+		}
+
+		if (status == "" || delivery.Status == status) && (eventType == "" || delivery.Event == eventType) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Id > deliveries[j].Id
+	})
+
+	respondWithJSON(w, http.StatusOK, paginateRanked(w, r, deliveries, page))
+}
+
+// handlerRedeliverWebhook sends a delivery again whatever its status, for
+// example to recover one from the dead letter list once the receiver is
+// fixed.
+func (cfg *apiConfig) handlerRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	endpoint, ok := cfg.loadOwnedEndpoint(w, r)
+
+	if !ok {
+		return
+	}
+
+	deliveryId, err := strconv.Atoi(r.PathValue("deliveryId"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return
+	}
+
+	delivery, err := cfg.DB.GetWebhookDelivery(deliveryId)
+
+	if errors.Is(err, database.ErrWebhookDeliveryNotFound) || (err == nil && delivery.Endpoint_Id != endpoint.Id) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook delivery")
+		return
+	}
+
+	delivery, err = cfg.DB.RedeliverWebhook(delivery.Id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not queue webhook delivery")
+		return
+	}
+
+	cfg.Webhooks.Wake()
+
+	respondWithJSON(w, http.StatusAccepted, delivery)
+}
+
+func (cfg *apiConfig) ownedWebhookEndpoints(userId int) ([]database.WebhookEndpoint, error) {
+	endpoints, err := cfg.DB.GetWebhookEndpoints()
+
+	if err != nil {
+		return nil, err
+	}
+
+	owned := []database.WebhookEndpoint{}
+
+	for _, endpoint := range endpoints {
+		if endpoint.Owner_Id == userId {
+			owned = append(owned, endpoint)
+		}
+	}
+
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[i].Id < owned[j].Id
+	})
+
+	return owned, nil
+}
+
+// loadOwnedEndpoint loads the endpoint in the path, treating other users'
+// endpoints as missing.
+func (cfg *apiConfig) loadOwnedEndpoint(w http.ResponseWriter, r *http.Request) (database.WebhookEndpoint, bool) {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return database.WebhookEndpoint{}, false
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return database.WebhookEndpoint{}, false
+	}
+
+	endpoint, err := cfg.DB.GetWebhookEndpoint(id)
+
+	if errors.Is(err, database.ErrWebhookEndpointNotFound) || (err == nil && endpoint.Owner_Id != userId) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return database.WebhookEndpoint{}, false
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook endpoint")
+		return database.WebhookEndpoint{}, false
+	}
+
+	return endpoint, true
+}
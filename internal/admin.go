@@ -0,0 +1,123 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrResetTokenInvalid = errors.New("password reset token is invalid or expired")
+
+type PasswordReset struct {
+	User_Id    int       `json:"user_id"`
+	Expires_At time.Time `json:"expires_at"`
+}
+
+func (db *DB) UnsuspendUser(id int) error {
+	return db.modifyUser(id, func(user *User) {
+		user.Is_Suspended = false
+		user.Suspension = ""
+	})
+}
+
+// RevokeSessions revokes every refresh token of the user and invalidates the
+// access tokens issued so far.
+func (db *DB) RevokeSessions(id int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		dbStructure.revokeSessions(&user)
+		dbStructure.Users[id] = user
+
+		return nil
+	})
+}
+
+// RequirePasswordReset stores a reset token for the user, revokes their
+// sessions and blocks login until the token is used.
+func (db *DB) RequirePasswordReset(id int, tokenHash string, expiresAt time.Time) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		for hash, reset := range dbStructure.PasswordResets {
+			if reset.User_Id == id {
+				delete(dbStructure.PasswordResets, hash)
+			}
+		}
+
+		dbStructure.PasswordResets[tokenHash] = PasswordReset{User_Id: id, Expires_At: expiresAt}
+		dbStructure.revokeSessions(&user)
+		user.Must_Reset_Password = true
+		dbStructure.Users[id] = user
+
+		return nil
+	})
+}
+
+// ResetPassword consumes a reset token, setting the user's new password.
+func (db *DB) ResetPassword(tokenHash string, password []byte) (User, error) {
+	user := User{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		reset, ok := dbStructure.PasswordResets[tokenHash]
+
+		if !ok || time.Now().UTC().After(reset.Expires_At) {
+			return ErrResetTokenInvalid
+		}
+
+		user, ok = dbStructure.Users[reset.User_Id]
+
+		if !ok {
+			return ErrResetTokenInvalid
+		}
+
+		delete(dbStructure.PasswordResets, tokenHash)
+		dbStructure.revokeSessions(&user)
+		user.Password = password
+		user.Must_Reset_Password = false
+		dbStructure.Users[user.Id] = user
+
+		return nil
+	})
+
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// revokeSessions clears the user's refresh tokens the same way
+// RevokeRefreshToken does. Tokens_Revoked_At is truncated to the second to
+// match token issue times.
+func (dbStructure *DBStructure) revokeSessions(user *User) {
+	for id, token := range dbStructure.RefreshTokens {
+		if token.UserId == user.Id {
+			dbStructure.RefreshTokens[id] = RefreshToken{}
+		}
+	}
+
+	user.Tokens_Revoked_At = time.Now().UTC().Truncate(time.Second)
+}
+
+func (db *DB) modifyUser(id int, change func(user *User)) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[id]
+
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		change(&user)
+		dbStructure.Users[id] = user
+
+		return nil
+	})
+}
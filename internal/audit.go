@@ -0,0 +1,293 @@
+package database
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type AuditEntry struct {
+	Id         int       `json:"id"`
+	Time       time.Time `json:"time"`
+	Actor_Id   int       `json:"actor_id"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target,omitempty"`
+	Ip         string    `json:"ip,omitempty"`
+	User_Agent string    `json:"user_agent,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Prev_Hash  string    `json:"prev_hash"`
+	Hash       string    `json:"hash"`
+}
+
+type AuditFilter struct {
+	Actor_Id *int
+	Action   string
+	Target   string
+	Outcome  string
+	Since    time.Time
+	Until    time.Time
+}
+
+// AuditLog is an append-only JSON Lines file. Each entry's hash covers the
+// entry and the previous entry's hash, so editing or removing an entry breaks
+// the chain from that point on. It is kept apart from the database file,
+// which is rewritten on every change.
+type AuditLog struct {
+	path     string
+	mux      *sync.Mutex
+	size     int64
+	lastId   int
+	lastHash string
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	auditLog := &AuditLog{
+		path: path,
+		mux:  &sync.Mutex{},
+	}
+
+	auditLog.mux.Lock()
+	defer auditLog.mux.Unlock()
+
+	return auditLog, auditLog.loadTailLocked()
+}
+
+// loadTailLocked finds the last entry when the file has changed size since
+// this process last wrote it, such as after `chirpy admin` appended to it.
+func (auditLog *AuditLog) loadTailLocked() error {
+	info, err := os.Stat(auditLog.path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == auditLog.size {
+		return nil
+	}
+
+	err = auditLog.scanLocked(func(entry AuditEntry) error {
+		auditLog.lastId = entry.Id
+		auditLog.lastHash = entry.Hash
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	auditLog.size = info.Size()
+
+	return nil
+}
+
+// Append assigns the entry its id, time and hashes and writes it to the end
+// of the log. The lock file is held from reading the last entry until the
+// write, so the server and `chirpy admin` cannot both chain onto the same
+// entry.
+func (auditLog *AuditLog) Append(entry AuditEntry) (AuditEntry, error) {
+	auditLog.mux.Lock()
+	defer auditLog.mux.Unlock()
+
+	unlock, err := lockFile(auditLog.path + ".lock")
+
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	defer unlock()
+
+	err = auditLog.loadTailLocked()
+
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	entry.Id = auditLog.lastId + 1
+	entry.Time = time.Now().UTC()
+	entry.Prev_Hash = auditLog.lastHash
+	entry.Hash = hashAuditEntry(entry)
+
+	dat, err := json.Marshal(entry)
+
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	file, err := os.OpenFile(auditLog.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	defer file.Close()
+
+	n, err := file.Write(append(dat, '\n'))
+
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	err = file.Sync()
+
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	auditLog.size += int64(n)
+	auditLog.lastId = entry.Id
+	auditLog.lastHash = entry.Hash
+
+	return entry, nil
+}
+
+func (auditLog *AuditLog) Entries(filter AuditFilter) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+
+	err := auditLog.scan(func(entry AuditEntry) error {
+		if filter.matches(entry) {
+			entries = append(entries, entry)
+		}
+
+		return nil
+	})
+
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+
+	return entries, err
+}
+
+// Verify walks the chain and returns an error describing the first entry
+// whose hash or link to the previous entry does not match.
+func (auditLog *AuditLog) Verify() (int, error) {
+	count := 0
+	prevHash := ""
+
+	err := auditLog.scan(func(entry AuditEntry) error {
+		if entry.Prev_Hash != prevHash {
+			return fmt.Errorf("audit entry %d does not follow the previous entry", entry.Id)
+		}
+
+		if entry.Hash != hashAuditEntry(entry) {
+			return fmt.Errorf("audit entry %d has been modified", entry.Id)
+		}
+
+		prevHash = entry.Hash
+		count++
+
+		return nil
+	})
+
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	return count, err
+}
+
+// Export copies the raw log to w, so the exported lines keep the exact bytes
+// the hashes were computed over.
+func (auditLog *AuditLog) Export(w io.Writer) error {
+	file, err := os.Open(auditLog.path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+
+	return err
+}
+
+func (auditLog *AuditLog) scan(fn func(entry AuditEntry) error) error {
+	auditLog.mux.Lock()
+	defer auditLog.mux.Unlock()
+
+	return auditLog.scanLocked(fn)
+}
+
+func (auditLog *AuditLog) scanLocked(fn func(entry AuditEntry) error) error {
+	file, err := os.Open(auditLog.path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		entry := AuditEntry{}
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(entry)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func hashAuditEntry(entry AuditEntry) string {
+	entry.Hash = ""
+	entry.Time = entry.Time.UTC()
+
+	dat, _ := json.Marshal(entry)
+	sum := sha256.Sum256(dat)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func (filter AuditFilter) matches(entry AuditEntry) bool {
+	if filter.Actor_Id != nil && entry.Actor_Id != *filter.Actor_Id {
+		return false
+	}
+
+	if filter.Action != "" && entry.Action != filter.Action {
+		return false
+	}
+
+	if filter.Target != "" && entry.Target != filter.Target {
+		return false
+	}
+
+	if filter.Outcome != "" && entry.Outcome != filter.Outcome {
+		return false
+	}
+
+	if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+		return false
+	}
+
+	if !filter.Until.IsZero() && !entry.Time.Before(filter.Until) {
+		return false
+	}
+
+	return true
+}
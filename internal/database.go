@@ -4,32 +4,93 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 )
 
+var ErrUserNotFound = errors.New("user not found")
+var ErrChirpNotFound = errors.New("chirp not found")
+var ErrBlocked = errors.New("user is blocked")
+var ErrHandleTaken = errors.New("handle already taken")
+
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path   string
+	mux    *sync.RWMutex
+	index  *searchIndex
+	events *ChirpEvents
 }
 
 type DBStructure struct {
-	Chirps        map[int]Chirp        `json:"chirps"`
-	Users         map[int]User         `json:"users"`
-	RefreshTokens map[int]RefreshToken `json:"refreshTokens"`
+	Chirps        map[int]Chirp           `json:"chirps"`
+	Users         map[int]User            `json:"users"`
+	RefreshTokens map[int]RefreshToken    `json:"refreshTokens"`
+	Blocks        map[int][]int           `json:"blocks"`
+	Mutes         map[int][]int           `json:"mutes"`
+	ChirpHistory  map[int][]ChirpRevision `json:"chirpHistory"`
+	Likes         map[int][]Engagement    `json:"likes"`
+	Rechirps      map[int][]Engagement    `json:"rechirps"`
+	Follows       map[int][]int           `json:"follows"`
+	Hashtags      map[string][]int        `json:"hashtags"`
+	Notifications map[int]Notification    `json:"notifications"`
+	Reports       map[int]Report          `json:"reports"`
+	// PasswordResets is keyed by the SHA-256 hash of the reset token.
+	PasswordResets map[string]PasswordReset `json:"passwordResets"`
+	WebhookEvents  map[string]WebhookEvent  `json:"webhookEvents"`
+	// WebhookEndpoints and WebhookDeliveries are the outgoing webhooks.
+	WebhookEndpoints  map[int]WebhookEndpoint `json:"webhookEndpoints"`
+	WebhookDeliveries map[int]WebhookDelivery `json:"webhookDeliveries"`
+	// The rest hold ActivityPub federation with other servers.
+	ActorKeys            map[int]ActorKey           `json:"actorKeys"`
+	RemoteFollowers      map[int][]RemoteFollower   `json:"remoteFollowers"`
+	RemoteLikes          map[int][]RemoteLike       `json:"remoteLikes"`
+	RemoteNotes          map[string]RemoteNote      `json:"remoteNotes"`
+	Tombstones           map[int]Tombstone          `json:"tombstones"`
+	FederationDeliveries map[int]FederationDelivery `json:"federationDeliveries"`
 }
 
 type Chirp struct {
-	Id        int    `json:"id"`
-	Body      string `json:"body"`
-	Author_Id int    `json:"author_id"`
+	Id          int       `json:"id"`
+	Body        string    `json:"body"`
+	Author_Id   int       `json:"author_id"`
+	In_Reply_To int       `json:"in_reply_to,omitempty"`
+	Quote_Of    int       `json:"quote_of,omitempty"`
+	Entities    []Entity  `json:"entities,omitempty"`
+	Created_At  time.Time `json:"created_at"`
+	Updated_At  time.Time `json:"updated_at"`
+}
+
+type ChirpCounts struct {
+	Replies  int `json:"replies"`
+	Likes    int `json:"likes"`
+	Rechirps int `json:"rechirps"`
+	Quotes   int `json:"quotes"`
+}
+
+type ChirpRevision struct {
+	Body       string    `json:"body"`
+	Updated_At time.Time `json:"updated_at"`
 }
 
 type User struct {
 	Id            int    `json:"id"`
 	Email         string `json:"email"`
+	Handle        string `json:"handle,omitempty"`
 	Password      []byte `json:"password"`
+	Role          string `json:"role,omitempty"`
 	Is_Chirpy_Red bool   `json:"is_chirpy_red"`
+	Is_Suspended  bool   `json:"is_suspended"`
+	Suspension    string `json:"suspension,omitempty"`
+	// Must_Reset_Password blocks login until the user sets a new password
+	// with a reset token.
+	Must_Reset_Password bool `json:"must_reset_password,omitempty"`
+	// Tokens_Revoked_At invalidates every access token issued before it.
+	Tokens_Revoked_At time.Time    `json:"tokens_revoked_at"`
+	Subscription      Subscription `json:"subscription"`
+	// Notification_Preferences holds the notification types the user has
+	// turned on or off. Types not listed are on.
+	Notification_Preferences map[string]bool `json:"notification_preferences,omitempty"`
 }
 
 type RefreshToken struct {
@@ -41,40 +102,67 @@ type RefreshToken struct {
 func NewDB(path string) (*DB, error) {
 
 	db := &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:   path,
+		mux:    &sync.RWMutex{},
+		index:  newSearchIndex(),
+		events: newChirpEvents(),
 	}
 	err := db.ensureDB()
 
-	return db, err
+	if err != nil {
+		return db, err
+	}
 
-}
+	// Writing the database back once stores what ensureMaps migrated, so
+	// migrations run once rather than on every read.
+	dbStructure := DBStructure{}
 
-func (db *DB) CreateUser(email string, password []byte) (User, error) {
-	dbStructure, err := db.loadDB()
+	err = db.update(func(current *DBStructure) error {
+		dbStructure = *current
+
+		return nil
+	})
 
 	if err != nil {
-		return User{}, err
+		return db, err
 	}
 
-	id := len(dbStructure.Users) + 1
-
-	user := User{
-		Id:            id,
-		Email:         email,
-		Password:      password,
-		Is_Chirpy_Red: false,
+	for _, chirp := range dbStructure.Chirps {
+		db.index.add(chirp)
 	}
 
-	for _, dbUser := range dbStructure.Users {
-		if string(dbUser.Email) == string(user.Email) {
-			return User{}, errors.New("User Already Exists")
+	return db, nil
+
+}
+
+func (db *DB) CreateUser(email, handle string, password []byte) (User, error) {
+	user := User{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		id := len(dbStructure.Users) + 1
+
+		user = User{
+			Id:            id,
+			Email:         email,
+			Handle:        handle,
+			Password:      password,
+			Is_Chirpy_Red: false,
+		}
+
+		for _, dbUser := range dbStructure.Users {
+			if string(dbUser.Email) == string(user.Email) {
+				return errors.New("User Already Exists")
+			}
+		}
+
+		if dbStructure.handleTaken(handle, id) {
+			return ErrHandleTaken
 		}
-	}
 
-	dbStructure.Users[id] = user
+		dbStructure.Users[id] = user
 
-	err = db.writeDB(dbStructure)
+		return nil
+	})
 
 	if err != nil {
 		return User{}, err
@@ -84,55 +172,53 @@ func (db *DB) CreateUser(email string, password []byte) (User, error) {
 }
 
 func (db *DB) WriteRefreshToken(refreshTokenString, expiration string, id int) error {
-	dbStructure, err := db.loadDB()
-
-	if err != nil {
-		return err
-	}
+	return db.update(func(dbStructure *DBStructure) error {
+		dbId := len(dbStructure.RefreshTokens) + 1
 
-	dbId := len(dbStructure.RefreshTokens) + 1
+		refreshToken := RefreshToken{
+			UserId:      id,
+			TokenString: refreshTokenString,
+			Expiration:  expiration,
+		}
 
-	refreshToken := RefreshToken{
-		UserId:      id,
-		TokenString: refreshTokenString,
-		Expiration:  expiration,
-	}
+		dbStructure.RefreshTokens[dbId] = refreshToken
 
-	dbStructure.RefreshTokens[dbId] = refreshToken
+		return nil
+	})
+}
 
-	err = db.writeDB(dbStructure)
+func (db *DB) UpdateUser(idString, email, handle string, password []byte) (User, error) {
+	id, err := strconv.ParseInt(idString, 10, 0)
 
 	if err != nil {
-		return err
+		return User{}, err
 	}
 
-	return nil
-
-}
+	user := User{}
 
-func (db *DB) UpdateUser(idString, email string, password []byte) (User, error) {
-	dbStructure, err := db.loadDB()
+	err = db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[int(id)]
 
-	if err != nil {
-		return User{}, err
-	}
+		if !ok {
+			return ErrUserNotFound
+		}
 
-	id, err := strconv.ParseInt(idString, 10, 0)
+		if handle != "" {
+			if dbStructure.handleTaken(handle, user.Id) {
+				return ErrHandleTaken
+			}
 
-	if err != nil {
-		return User{}, err
-	}
+			user.Handle = handle
+		}
 
-	user := User{
-		Id:            int(id),
-		Email:         email,
-		Password:      password,
-		Is_Chirpy_Red: dbStructure.Users[int(id)].Is_Chirpy_Red,
-	}
+		user.Email = email
+		user.Password = password
 
-	dbStructure.Users[int(id)] = user
+		dbStructure.Users[int(id)] = user
 
-	err = db.writeDB(dbStructure)
+		return nil
+	})
 
 	if err != nil {
 		return User{}, err
@@ -142,42 +228,35 @@ func (db *DB) UpdateUser(idString, email string, password []byte) (User, error)
 
 }
 
-func (db *DB) UpdateChirpyRed(id int) error {
-	dbStructure, err := db.loadDB()
-
-	if err != nil {
-		return err
-	}
-
-	_, ok := dbStructure.Users[id]
-
-	if ok {
-		for _, user := range dbStructure.Users {
-			if user.Id == id {
-				newUser := User{
-					Id:            user.Id,
-					Email:         user.Email,
-					Password:      user.Password,
-					Is_Chirpy_Red: true,
-				}
+// SuspendUser marks a user suspended, recording reason so it can be shown to
+// them.
+func (db *DB) SuspendUser(id int, reason string) error {
+	return db.modifyUser(id, func(user *User) {
+		user.Is_Suspended = true
+		user.Suspension = reason
+	})
+}
 
-				dbStructure.Users[user.Id] = newUser
-			}
+func (db *DB) SetUserRole(id int, role string) error {
+	return db.modifyUser(id, func(user *User) {
+		user.Role = role
+	})
+}
 
-		}
+func (db *DB) GetUser(id int) (User, error) {
+	dbStructure, err := db.loadDB()
 
-	} else {
-		return errors.New("user not found")
+	if err != nil {
+		return User{}, err
 	}
 
-	err = db.writeDB(dbStructure)
+	user, ok := dbStructure.Users[id]
 
-	if err != nil {
-		return err
+	if !ok {
+		return User{}, ErrUserNotFound
 	}
 
-	return nil
-
+	return user, nil
 }
 
 func (db *DB) GetUsers() ([]User, error) {
@@ -213,46 +292,56 @@ func (db *DB) GetRefreshTokens() ([]RefreshToken, error) {
 }
 
 func (db *DB) RevokeRefreshToken(tokenString string) error {
-	dbStructure, err := db.loadDB()
+	return db.update(func(dbStructure *DBStructure) error {
+		id := 0
 
-	if err != nil {
-		return err
-	}
+		for i, dbToken := range dbStructure.RefreshTokens {
 
-	id := 0
-
-	for i, dbToken := range dbStructure.RefreshTokens {
+			if dbToken.TokenString == tokenString {
+				id = i
+			}
+		}
 
-		if dbToken.TokenString == tokenString {
-			id = i
+		token := RefreshToken{
+			UserId:      0,
+			Expiration:  "",
+			TokenString: "",
 		}
-	}
 
-	token := RefreshToken{
-		UserId:      0,
-		Expiration:  "",
-		TokenString: "",
-	}
+		dbStructure.RefreshTokens[id] = token
 
-	dbStructure.RefreshTokens[id] = token
+		return nil
+	})
+}
 
-	err = db.writeDB(dbStructure)
+func (db *DB) DeleteChirp(chirpId int) error {
+	deleted := Chirp{}
 
-	if err != nil {
+	err := db.update(func(dbStructure *DBStructure) error {
+		var err error
+		deleted, err = dbStructure.deleteChirp(chirpId)
+
+		return err
+	})
+
+	if errors.Is(err, ErrChirpNotFound) {
 		return err
 	}
 
-	return nil
+	if err != nil {
+		return errors.New("could not update db")
+	}
 
-}
+	db.chirpDeleted(deleted)
 
-func (db *DB) DeleteChirp(chirpId int) error {
-	dbStructure, err := db.loadDB()
+	return nil
 
-	if err != nil {
-		return err
-	}
+}
 
+// deleteChirp blanks a chirp and leaves a tombstone in its place, returning
+// the chirp as it was. The caller must pass it to chirpDeleted once the
+// change is written.
+func (dbStructure *DBStructure) deleteChirp(chirpId int) (Chirp, error) {
 	id := 0
 
 	for i, chirp := range dbStructure.Chirps {
@@ -262,6 +351,19 @@ func (db *DB) DeleteChirp(chirpId int) error {
 		}
 	}
 
+	if chirpId == 0 || dbStructure.Chirps[id].Id != chirpId {
+		return Chirp{}, ErrChirpNotFound
+	}
+
+	deleted := dbStructure.Chirps[id]
+	dbStructure.unindexHashtags(deleted)
+
+	dbStructure.Tombstones[deleted.Id] = Tombstone{
+		Chirp_Id:   deleted.Id,
+		Author_Id:  deleted.Author_Id,
+		Deleted_At: time.Now().UTC(),
+	}
+
 	chirp := Chirp{
 		Id:        0,
 		Body:      "",
@@ -270,40 +372,196 @@ func (db *DB) DeleteChirp(chirpId int) error {
 
 	dbStructure.Chirps[id] = chirp
 
-	err = db.writeDB(dbStructure)
+	return deleted, nil
+}
+
+// chirpDeleted drops a deleted chirp from the search index and publishes its
+// deletion.
+func (db *DB) chirpDeleted(deleted Chirp) {
+	db.index.remove(deleted.Id)
+	db.events.publish("chirp.deleted", deleted)
+}
+
+func (db *DB) CreateChirp(chirp Chirp) (Chirp, error) {
+	err := db.update(func(dbStructure *DBStructure) error {
+		for _, referencedId := range []int{chirp.In_Reply_To, chirp.Quote_Of} {
+			if referencedId == 0 {
+				continue
+			}
+
+			referenced, ok := dbStructure.Chirps[referencedId]
+
+			if !ok || referenced.Id == 0 {
+				return ErrChirpNotFound
+			}
+		}
+
+		id := len(dbStructure.Chirps) + 1
+		now := time.Now().UTC()
+
+		chirp.Id = id
+		chirp.Created_At = now
+		chirp.Updated_At = now
+		dbStructure.Chirps[id] = chirp
+		dbStructure.indexHashtags(chirp)
+
+		return nil
+	})
 
 	if err != nil {
-		return errors.New("could not update db")
+		return Chirp{}, err
 	}
 
-	return nil
+	db.index.add(chirp)
+	db.events.publish("chirp.created", chirp)
+
+	return chirp, nil
 
 }
 
-func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) UpdateChirp(id int, body string, entities []Entity) (Chirp, error) {
+	chirp := Chirp{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStructure.Chirps[id]
+
+		if !ok || chirp.Id == 0 {
+			return ErrChirpNotFound
+		}
+
+		dbStructure.ChirpHistory[id] = append(dbStructure.ChirpHistory[id], ChirpRevision{
+			Body:       chirp.Body,
+			Updated_At: chirp.Updated_At,
+		})
+
+		dbStructure.unindexHashtags(chirp)
+
+		chirp.Body = body
+		chirp.Entities = entities
+		chirp.Updated_At = time.Now().UTC()
+		dbStructure.Chirps[id] = chirp
+
+		dbStructure.indexHashtags(chirp)
+
+		return nil
+	})
 
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	id := len(dbStructure.Chirps) + 1
+	db.index.add(chirp)
+	db.events.publish("chirp.updated", chirp)
 
-	chirp := Chirp{
-		Id:        id,
-		Body:      body,
-		Author_Id: userID,
+	return chirp, nil
+}
+
+func (db *DB) GetChirpHistory(id int) ([]ChirpRevision, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
 	}
-	dbStructure.Chirps[id] = chirp
 
-	err = db.writeDB(dbStructure)
+	chirp, ok := dbStructure.Chirps[id]
+
+	if !ok || chirp.Id == 0 {
+		return nil, ErrChirpNotFound
+	}
+
+	history := append([]ChirpRevision{}, dbStructure.ChirpHistory[id]...)
+
+	history = append(history, ChirpRevision{
+		Body:       chirp.Body,
+		Updated_At: chirp.Updated_At,
+	})
+
+	return history, nil
+}
+
+func (db *DB) GetChirp(id int) (Chirp, error) {
+	dbStructure, err := db.loadDB()
 
 	if err != nil {
 		return Chirp{}, err
 	}
 
+	chirp, ok := dbStructure.Chirps[id]
+
+	if !ok || chirp.Id == 0 {
+		return Chirp{}, ErrChirpNotFound
+	}
+
 	return chirp, nil
+}
+
+func (db *DB) GetChirpCounts() (map[int]ChirpCounts, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[int]ChirpCounts{}
+
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.Id == 0 {
+			continue
+		}
+
+		if chirp.In_Reply_To != 0 {
+			parentCounts := counts[chirp.In_Reply_To]
+			parentCounts.Replies++
+			counts[chirp.In_Reply_To] = parentCounts
+		}
 
+		if chirp.Quote_Of != 0 {
+			quotedCounts := counts[chirp.Quote_Of]
+			quotedCounts.Quotes++
+			counts[chirp.Quote_Of] = quotedCounts
+		}
+	}
+
+	for chirpId, likes := range dbStructure.Likes {
+		chirpCounts := counts[chirpId]
+		chirpCounts.Likes = len(likes)
+		counts[chirpId] = chirpCounts
+	}
+
+	for chirpId, rechirps := range dbStructure.Rechirps {
+		chirpCounts := counts[chirpId]
+		chirpCounts.Rechirps = len(rechirps)
+		counts[chirpId] = chirpCounts
+	}
+
+	for chirpId, likes := range dbStructure.RemoteLikes {
+		chirpCounts := counts[chirpId]
+		chirpCounts.Likes += len(likes)
+		counts[chirpId] = chirpCounts
+	}
+
+	return counts, nil
+}
+
+func (db *DB) GetChirpsById(ids []int) (map[int]Chirp, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	chirps := map[int]Chirp{}
+
+	for _, id := range ids {
+		chirp, ok := dbStructure.Chirps[id]
+
+		if ok && chirp.Id != 0 {
+			chirps[id] = chirp
+		}
+	}
+
+	return chirps, nil
 }
 
 func (db *DB) GetChirps() ([]Chirp, error) {
@@ -316,6 +574,10 @@ func (db *DB) GetChirps() ([]Chirp, error) {
 	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
 
 	for _, chirp := range dbStructure.Chirps {
+		if chirp.Id == 0 {
+			continue
+		}
+
 		chirps = append(chirps, chirp)
 	}
 
@@ -327,6 +589,41 @@ func (db *DB) loadDB() (DBStructure, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
+	return db.readFile()
+}
+
+// update runs fn against the current contents and writes the result while
+// holding the write lock and the lock file, so concurrent read-modify-write
+// cycles, including ones from the admin CLI, cannot overwrite each other.
+// Nothing is written if fn returns an error.
+func (db *DB) update(fn func(dbStructure *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	unlock, err := lockFile(db.path + ".lock")
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	dbStructure, err := db.readFile()
+
+	if err != nil {
+		return err
+	}
+
+	err = fn(&dbStructure)
+
+	if err != nil {
+		return err
+	}
+
+	return db.writeFile(dbStructure)
+}
+
+func (db *DB) readFile() (DBStructure, error) {
 	dbStructure := DBStructure{}
 
 	data, err := os.ReadFile(db.path)
@@ -341,6 +638,8 @@ func (db *DB) loadDB() (DBStructure, error) {
 		return dbStructure, err
 	}
 
+	dbStructure.ensureMaps()
+
 	return dbStructure, nil
 
 }
@@ -357,30 +656,136 @@ func (db *DB) ensureDB() error {
 }
 
 func (db *DB) createDB() error {
-	dbStructure := DBStructure{
-		Chirps:        map[int]Chirp{},
-		Users:         map[int]User{},
-		RefreshTokens: map[int]RefreshToken{},
-	}
+	dbStructure := DBStructure{}
+	dbStructure.ensureMaps()
 	return db.writeDB(dbStructure)
 }
 
+// ensureMaps initializes any collection missing from the file, so databases
+// written before a collection existed can still be loaded and written, and
+// brings older records up to date.
+func (dbStructure *DBStructure) ensureMaps() {
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = map[int]Chirp{}
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = map[int]User{}
+	}
+	if dbStructure.RefreshTokens == nil {
+		dbStructure.RefreshTokens = map[int]RefreshToken{}
+	}
+	if dbStructure.Blocks == nil {
+		dbStructure.Blocks = map[int][]int{}
+	}
+	if dbStructure.Mutes == nil {
+		dbStructure.Mutes = map[int][]int{}
+	}
+	if dbStructure.ChirpHistory == nil {
+		dbStructure.ChirpHistory = map[int][]ChirpRevision{}
+	}
+	if dbStructure.Likes == nil {
+		dbStructure.Likes = map[int][]Engagement{}
+	}
+	if dbStructure.Rechirps == nil {
+		dbStructure.Rechirps = map[int][]Engagement{}
+	}
+	if dbStructure.Follows == nil {
+		dbStructure.Follows = map[int][]int{}
+	}
+	if dbStructure.Hashtags == nil {
+		dbStructure.Hashtags = map[string][]int{}
+
+		for _, chirp := range dbStructure.Chirps {
+			dbStructure.indexHashtags(chirp)
+		}
+	}
+	if dbStructure.Notifications == nil {
+		dbStructure.Notifications = map[int]Notification{}
+	}
+	if dbStructure.Reports == nil {
+		dbStructure.Reports = map[int]Report{}
+	}
+	if dbStructure.PasswordResets == nil {
+		dbStructure.PasswordResets = map[string]PasswordReset{}
+	}
+	if dbStructure.WebhookEvents == nil {
+		dbStructure.WebhookEvents = map[string]WebhookEvent{}
+	}
+	if dbStructure.WebhookEndpoints == nil {
+		dbStructure.WebhookEndpoints = map[int]WebhookEndpoint{}
+	}
+	if dbStructure.WebhookDeliveries == nil {
+		dbStructure.WebhookDeliveries = map[int]WebhookDelivery{}
+	}
+	if dbStructure.ActorKeys == nil {
+		dbStructure.ActorKeys = map[int]ActorKey{}
+	}
+	if dbStructure.RemoteFollowers == nil {
+		dbStructure.RemoteFollowers = map[int][]RemoteFollower{}
+	}
+	if dbStructure.RemoteLikes == nil {
+		dbStructure.RemoteLikes = map[int][]RemoteLike{}
+	}
+	if dbStructure.RemoteNotes == nil {
+		dbStructure.RemoteNotes = map[string]RemoteNote{}
+	}
+	if dbStructure.Tombstones == nil {
+		dbStructure.Tombstones = map[int]Tombstone{}
+	}
+	if dbStructure.FederationDeliveries == nil {
+		dbStructure.FederationDeliveries = map[int]FederationDelivery{}
+	}
+
+	dbStructure.migrateLegacySubscriptions(time.Now().UTC())
+}
+
 func (db *DB) writeDB(dbStructure DBStructure) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
+	unlock, err := lockFile(db.path + ".lock")
+
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	return db.writeFile(dbStructure)
+}
+
+// writeFile replaces the database file by renaming a fully written temporary
+// file over it, so readers in this or another process never see a partial
+// write.
+func (db *DB) writeFile(dbStructure DBStructure) error {
 	dat, err := json.Marshal(dbStructure)
 
 	if err != nil {
 		return err
 	}
 
-	err = os.WriteFile(db.path, dat, 0600)
+	tmp, err := os.CreateTemp(filepath.Dir(db.path), filepath.Base(db.path)+".tmp*")
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(dat)
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), db.path)
 
 }
@@ -0,0 +1,310 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrWebhookEndpointNotFound = errors.New("webhook endpoint not found")
+var ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+
+// WebhookEndpoint is a URL registered to receive outgoing webhooks for the
+// listed events. Firehose endpoints receive every event rather than only
+// those about their owner.
+type WebhookEndpoint struct {
+	Id         int       `json:"id"`
+	Owner_Id   int       `json:"owner_id"`
+	Url        string    `json:"url"`
+	Secret     string    `json:"secret"`
+	Events     []string  `json:"events"`
+	Firehose   bool      `json:"firehose"`
+	Created_At time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event queued for one endpoint. Payload holds the
+// exact body sent, so redeliveries are identical apart from their signature
+// timestamp.
+type WebhookDelivery struct {
+	Id              int               `json:"id"`
+	Endpoint_Id     int               `json:"endpoint_id"`
+	Event_Id        string            `json:"event_id"`
+	Event           string            `json:"event"`
+	Payload         json.RawMessage   `json:"payload"`
+	Status          string            `json:"status"`
+	Attempts        int               `json:"attempts"`
+	Next_Attempt_At time.Time         `json:"next_attempt_at"`
+	Log             []DeliveryAttempt `json:"log"`
+	Created_At      time.Time         `json:"created_at"`
+	Delivered_At    *time.Time        `json:"delivered_at,omitempty"`
+}
+
+type DeliveryAttempt struct {
+	At          time.Time `json:"at"`
+	Status_Code int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Duration_Ms int64     `json:"duration_ms"`
+}
+
+func (db *DB) CreateWebhookEndpoint(endpoint WebhookEndpoint) (WebhookEndpoint, error) {
+	err := db.update(func(dbStructure *DBStructure) error {
+		_, ok := dbStructure.Users[endpoint.Owner_Id]
+
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		// Endpoints can be deleted, so ids continue from the highest one
+		// rather than the count.
+		for id := range dbStructure.WebhookEndpoints {
+			if id > endpoint.Id {
+				endpoint.Id = id
+			}
+		}
+
+		endpoint.Id++
+		endpoint.Created_At = time.Now().UTC()
+		dbStructure.WebhookEndpoints[endpoint.Id] = endpoint
+
+		return nil
+	})
+
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	return endpoint, nil
+}
+
+func (db *DB) GetWebhookEndpoint(id int) (WebhookEndpoint, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return WebhookEndpoint{}, err
+	}
+
+	endpoint, ok := dbStructure.WebhookEndpoints[id]
+
+	if !ok {
+		return WebhookEndpoint{}, ErrWebhookEndpointNotFound
+	}
+
+	return endpoint, nil
+}
+
+func (db *DB) GetWebhookEndpoints() ([]WebhookEndpoint, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]WebhookEndpoint, 0, len(dbStructure.WebhookEndpoints))
+
+	for _, endpoint := range dbStructure.WebhookEndpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, nil
+}
+
+// DeleteWebhookEndpoint removes the endpoint along with its deliveries, so
+// nothing more is sent to it.
+func (db *DB) DeleteWebhookEndpoint(id int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.WebhookEndpoints[id]; !ok {
+			return ErrWebhookEndpointNotFound
+		}
+
+		delete(dbStructure.WebhookEndpoints, id)
+
+		for deliveryId, delivery := range dbStructure.WebhookDeliveries {
+			if delivery.Endpoint_Id == id {
+				delete(dbStructure.WebhookDeliveries, deliveryId)
+			}
+		}
+
+		return nil
+	})
+}
+
+// QueueWebhookDeliveries stores deliveries as pending and due now, skipping
+// any whose endpoint has since been deleted.
+func (db *DB) QueueWebhookDeliveries(deliveries []WebhookDelivery) ([]WebhookDelivery, error) {
+	queued := []WebhookDelivery{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		nextId := 0
+
+		for id := range dbStructure.WebhookDeliveries {
+			if id > nextId {
+				nextId = id
+			}
+		}
+
+		now := time.Now().UTC()
+
+		for _, delivery := range deliveries {
+			if _, ok := dbStructure.WebhookEndpoints[delivery.Endpoint_Id]; !ok {
+				continue
+			}
+
+			nextId++
+			delivery.Id = nextId
+			delivery.Status = "pending"
+			delivery.Next_Attempt_At = now
+			delivery.Log = []DeliveryAttempt{}
+			delivery.Created_At = now
+			dbStructure.WebhookDeliveries[delivery.Id] = delivery
+			queued = append(queued, delivery)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return queued, nil
+}
+
+func (db *DB) GetWebhookDelivery(id int) (WebhookDelivery, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	delivery, ok := dbStructure.WebhookDeliveries[id]
+
+	if !ok {
+		return WebhookDelivery{}, ErrWebhookDeliveryNotFound
+	}
+
+	return delivery, nil
+}
+
+func (db *DB) GetWebhookDeliveries() ([]WebhookDelivery, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]WebhookDelivery, 0, len(dbStructure.WebhookDeliveries))
+
+	for _, delivery := range dbStructure.WebhookDeliveries {
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt appends attempt to the delivery's log and moves it to
+// status. Undelivered deliveries are next attempted at nextAttemptAt.
+func (db *DB) RecordWebhookAttempt(id int, attempt DeliveryAttempt, status string, nextAttemptAt time.Time) (WebhookDelivery, error) {
+	delivery := WebhookDelivery{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		delivery, ok = dbStructure.WebhookDeliveries[id]
+
+		if !ok {
+			return ErrWebhookDeliveryNotFound
+		}
+
+		delivery.Status = status
+		delivery.Attempts++
+		delivery.Log = append(delivery.Log, attempt)
+		delivery.Next_Attempt_At = nextAttemptAt
+
+		if status == "delivered" {
+			deliveredAt := attempt.At
+			delivery.Delivered_At = &deliveredAt
+		}
+
+		dbStructure.WebhookDeliveries[id] = delivery
+
+		return nil
+	})
+
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
+
+// PruneWebhookDeliveries deletes delivered deliveries, and dead ones, whose
+// last attempt was before cutoff.
+func (db *DB) PruneWebhookDeliveries(cutoff time.Time) error {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return err
+	}
+
+	prunable := func(delivery WebhookDelivery) bool {
+		if (delivery.Status != "delivered" && delivery.Status != "dead") || len(delivery.Log) == 0 {
+			return false
+		}
+
+		return delivery.Log[len(delivery.Log)-1].At.Before(cutoff)
+	}
+
+	found := false
+
+	for _, delivery := range dbStructure.WebhookDeliveries {
+		found = found || prunable(delivery)
+	}
+
+	if !found {
+		return nil
+	}
+
+	return db.update(func(dbStructure *DBStructure) error {
+		// The newest delivery is kept, as new ids continue from it.
+		lastId := 0
+
+		for id := range dbStructure.WebhookDeliveries {
+			lastId = max(lastId, id)
+		}
+
+		for id, delivery := range dbStructure.WebhookDeliveries {
+			if id != lastId && prunable(delivery) {
+				delete(dbStructure.WebhookDeliveries, id)
+			}
+		}
+
+		return nil
+	})
+}
+
+// RedeliverWebhook queues a delivery to be sent again now with a fresh set
+// of attempts, keeping the log of earlier ones.
+func (db *DB) RedeliverWebhook(id int) (WebhookDelivery, error) {
+	delivery := WebhookDelivery{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		delivery, ok = dbStructure.WebhookDeliveries[id]
+
+		if !ok {
+			return ErrWebhookDeliveryNotFound
+		}
+
+		delivery.Status = "pending"
+		delivery.Attempts = 0
+		delivery.Next_Attempt_At = time.Now().UTC()
+		dbStructure.WebhookDeliveries[id] = delivery
+
+		return nil
+	})
+
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return delivery, nil
+}
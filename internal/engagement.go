@@ -0,0 +1,100 @@
+package database
+
+import (
+	"slices"
+	"time"
+)
+
+type Engagement struct {
+	User_Id    int       `json:"user_id"`
+	Created_At time.Time `json:"created_at"`
+}
+
+func (db *DB) LikeChirp(chirpId, userId int) error {
+	return db.addEngagement("likes", chirpId, userId)
+}
+
+func (db *DB) UnlikeChirp(chirpId, userId int) error {
+	return db.removeEngagement("likes", chirpId, userId)
+}
+
+func (db *DB) Rechirp(chirpId, userId int) error {
+	return db.addEngagement("rechirps", chirpId, userId)
+}
+
+func (db *DB) Unrechirp(chirpId, userId int) error {
+	return db.removeEngagement("rechirps", chirpId, userId)
+}
+
+func (db *DB) GetLikes(chirpId int) ([]Engagement, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.Clone(dbStructure.Likes[chirpId]), nil
+}
+
+func (db *DB) GetRechirps() (map[int][]Engagement, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dbStructure.Rechirps, nil
+}
+
+func (db *DB) addEngagement(kind string, chirpId, userId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpId]
+
+		if !ok || chirp.Id == 0 {
+			return ErrChirpNotFound
+		}
+
+		if dbStructure.isBlocked(userId, chirp.Author_Id) {
+			return ErrBlocked
+		}
+
+		engagements := dbStructure.engagementMap(kind)
+
+		for _, engagement := range engagements[chirpId] {
+			if engagement.User_Id == userId {
+				return nil
+			}
+		}
+
+		engagements[chirpId] = append(engagements[chirpId], Engagement{
+			User_Id:    userId,
+			Created_At: time.Now().UTC(),
+		})
+
+		return nil
+	})
+}
+
+func (db *DB) removeEngagement(kind string, chirpId, userId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		engagements := dbStructure.engagementMap(kind)
+
+		engagements[chirpId] = slices.DeleteFunc(engagements[chirpId], func(engagement Engagement) bool {
+			return engagement.User_Id == userId
+		})
+
+		if len(engagements[chirpId]) == 0 {
+			delete(engagements, chirpId)
+		}
+
+		return nil
+	})
+}
+
+func (dbStructure *DBStructure) engagementMap(kind string) map[int][]Engagement {
+	if kind == "rechirps" {
+		return dbStructure.Rechirps
+	}
+
+	return dbStructure.Likes
+}
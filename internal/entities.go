@@ -0,0 +1,102 @@
+package database
+
+import (
+	"slices"
+	"strings"
+)
+
+// Entity is a hashtag, mention or URL found in a chirp body. Start and End
+// are byte offsets into the body, Rune_Start and Rune_End the same span
+// counted in runes.
+type Entity struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+	Rune_Start int    `json:"rune_start"`
+	Rune_End   int    `json:"rune_end"`
+	User_Id    int    `json:"user_id,omitempty"`
+}
+
+func (db *DB) GetChirpsByHashtag(tag string) ([]Chirp, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids := dbStructure.Hashtags[strings.ToLower(tag)]
+	chirps := make([]Chirp, 0, len(ids))
+
+	for _, id := range ids {
+		chirp, ok := dbStructure.Chirps[id]
+
+		if ok && chirp.Id != 0 {
+			chirps = append(chirps, chirp)
+		}
+	}
+
+	return chirps, nil
+}
+
+func (db *DB) GetUserByHandle(handle string) (User, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return User{}, err
+	}
+
+	for _, user := range dbStructure.Users {
+		if user.Handle != "" && strings.EqualFold(user.Handle, handle) {
+			return user, nil
+		}
+	}
+
+	return User{}, ErrUserNotFound
+}
+
+func (dbStructure *DBStructure) handleTaken(handle string, userId int) bool {
+	if handle == "" {
+		return false
+	}
+
+	for _, user := range dbStructure.Users {
+		if user.Id != userId && strings.EqualFold(user.Handle, handle) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (dbStructure *DBStructure) indexHashtags(chirp Chirp) {
+	if chirp.Id == 0 {
+		return
+	}
+
+	for _, entity := range chirp.Entities {
+		if entity.Type != "hashtag" || slices.Contains(dbStructure.Hashtags[entity.Value], chirp.Id) {
+			continue
+		}
+
+		dbStructure.Hashtags[entity.Value] = append(dbStructure.Hashtags[entity.Value], chirp.Id)
+	}
+}
+
+func (dbStructure *DBStructure) unindexHashtags(chirp Chirp) {
+	for _, entity := range chirp.Entities {
+		if entity.Type != "hashtag" {
+			continue
+		}
+
+		ids := slices.DeleteFunc(dbStructure.Hashtags[entity.Value], func(id int) bool {
+			return id == chirp.Id
+		})
+
+		if len(ids) == 0 {
+			delete(dbStructure.Hashtags, entity.Value)
+		} else {
+			dbStructure.Hashtags[entity.Value] = ids
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"sync"
+	"time"
+)
+
+const chirpEventBufferSize = 1000
+
+// subscriberBufferSize is how many events a subscriber can fall behind by
+// before it is dropped.
+const subscriberBufferSize = 64
+
+// ChirpEvent is a chirp being created, edited or deleted, published by the
+// database once the change is written. Ids increase by one per event from
+// the time the process started, in microseconds, so they keep increasing
+// across restarts and ids from before one can be recognised.
+type ChirpEvent struct {
+	Id   int       `json:"id"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Chirp is the chirp as created or edited, or as it was before it was
+	// deleted.
+	Chirp Chirp `json:"chirp"`
+}
+
+// ChirpEvents keeps the most recent events so subscribers can catch up on
+// what they missed, and fans new events out to subscribers.
+type ChirpEvents struct {
+	mux         *sync.Mutex
+	buffer      []ChirpEvent
+	firstId     int
+	lastId      int
+	subscribers map[*ChirpSubscription]bool
+}
+
+// ChirpSubscription receives events on C. C is closed when the subscriber
+// falls too far behind, after which it should subscribe again from the last
+// event it received. After is the id of the last event published before the
+// subscription started.
+type ChirpSubscription struct {
+	C      <-chan ChirpEvent
+	After  int
+	c      chan ChirpEvent
+	events *ChirpEvents
+}
+
+func newChirpEvents() *ChirpEvents {
+	epoch := int(time.Now().UnixMicro())
+
+	return &ChirpEvents{
+		mux:         &sync.Mutex{},
+		buffer:      []ChirpEvent{},
+		firstId:     epoch + 1,
+		lastId:      epoch,
+		subscribers: map[*ChirpSubscription]bool{},
+	}
+}
+
+func (db *DB) ChirpEvents() *ChirpEvents {
+	return db.events
+}
+
+func (events *ChirpEvents) publish(eventType string, chirp Chirp) {
+	events.mux.Lock()
+	defer events.mux.Unlock()
+
+	events.lastId++
+
+	event := ChirpEvent{
+		Id:    events.lastId,
+		Type:  eventType,
+		Time:  time.Now().UTC(),
+		Chirp: chirp,
+	}
+
+	events.buffer = append(events.buffer, event)
+
+	if len(events.buffer) > chirpEventBufferSize {
+		events.buffer = events.buffer[len(events.buffer)-chirpEventBufferSize:]
+	}
+
+	for sub := range events.subscribers {
+		select {
+		case sub.c <- event:
+		default:
+			delete(events.subscribers, sub)
+			close(sub.c)
+		}
+	}
+}
+
+// Subscribe returns a subscription to the events published from now on.
+func (events *ChirpEvents) Subscribe() *ChirpSubscription {
+	events.mux.Lock()
+	defer events.mux.Unlock()
+
+	return events.subscribeLocked()
+}
+
+// Resume returns the buffered events after lastId and a subscription to the
+// events that follow them. complete is false when some events after lastId
+// are no longer buffered, including when lastId is from before a restart.
+func (events *ChirpEvents) Resume(lastId int) (missed []ChirpEvent, complete bool, sub *ChirpSubscription) {
+	events.mux.Lock()
+	defer events.mux.Unlock()
+
+	missed = []ChirpEvent{}
+
+	for _, event := range events.buffer {
+		if event.Id > lastId {
+			missed = append(missed, event)
+		}
+	}
+
+	complete = lastId >= events.firstId-1 && lastId <= events.lastId
+
+	if len(events.buffer) > 0 && events.buffer[0].Id > lastId+1 {
+		complete = false
+	}
+
+	return missed, complete, events.subscribeLocked()
+}
+
+func (events *ChirpEvents) subscribeLocked() *ChirpSubscription {
+	c := make(chan ChirpEvent, subscriberBufferSize)
+	sub := &ChirpSubscription{C: c, After: events.lastId, c: c, events: events}
+	events.subscribers[sub] = true
+
+	return sub
+}
+
+func (sub *ChirpSubscription) Close() {
+	sub.events.mux.Lock()
+	defer sub.events.mux.Unlock()
+
+	if sub.events.subscribers[sub] {
+		delete(sub.events.subscribers, sub)
+		close(sub.c)
+	}
+}
@@ -0,0 +1,396 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrFederationDeliveryNotFound = errors.New("federation delivery not found")
+
+// ActorKey is the RSA key pair a user signs the activities they send with,
+// PEM encoded.
+type ActorKey struct {
+	Private_Key_Pem string `json:"private_key_pem"`
+	Public_Key_Pem  string `json:"public_key_pem"`
+}
+
+// RemoteFollower is an actor on another server following a local user.
+// Activities are delivered to its shared inbox when it has one.
+type RemoteFollower struct {
+	Actor        string    `json:"actor"`
+	Inbox        string    `json:"inbox"`
+	Shared_Inbox string    `json:"shared_inbox,omitempty"`
+	Follow_Id    string    `json:"follow_id"`
+	Created_At   time.Time `json:"created_at"`
+}
+
+// RemoteLike is a like of a local chirp by an actor on another server.
+type RemoteLike struct {
+	Actor       string    `json:"actor"`
+	Activity_Id string    `json:"activity_id"`
+	Created_At  time.Time `json:"created_at"`
+}
+
+// RemoteNote is a note from another server that replies to a local chirp or
+// mentions local users. Content is its text with the HTML removed.
+type RemoteNote struct {
+	Id          string    `json:"id"`
+	Actor       string    `json:"actor"`
+	Content     string    `json:"content"`
+	In_Reply_To int       `json:"in_reply_to,omitempty"`
+	Mentions    []int     `json:"mentions,omitempty"`
+	Published   time.Time `json:"published"`
+	Received_At time.Time `json:"received_at"`
+}
+
+// Tombstone records a deleted chirp so its author's outbox can list the
+// deletion.
+type Tombstone struct {
+	Chirp_Id   int       `json:"chirp_id"`
+	Author_Id  int       `json:"author_id"`
+	Deleted_At time.Time `json:"deleted_at"`
+}
+
+// FederationDelivery is an activity queued for a remote inbox. It is signed
+// as the local user Actor_Id when sent.
+type FederationDelivery struct {
+	Id              int               `json:"id"`
+	Actor_Id        int               `json:"actor_id"`
+	Inbox           string            `json:"inbox"`
+	Activity        json.RawMessage   `json:"activity"`
+	Status          string            `json:"status"`
+	Attempts        int               `json:"attempts"`
+	Next_Attempt_At time.Time         `json:"next_attempt_at"`
+	Log             []DeliveryAttempt `json:"log"`
+	Created_At      time.Time         `json:"created_at"`
+	Delivered_At    *time.Time        `json:"delivered_at,omitempty"`
+}
+
+// GetActorKey returns the user's key pair and whether they have one.
+func (db *DB) GetActorKey(userId int) (ActorKey, bool, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return ActorKey{}, false, err
+	}
+
+	key, ok := dbStructure.ActorKeys[userId]
+
+	return key, ok, nil
+}
+
+// CreateActorKey stores key for the user unless they already have one, and
+// returns the key they end up with, so concurrent callers agree.
+func (db *DB) CreateActorKey(userId int, key ActorKey) (ActorKey, error) {
+	err := db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[userId]; !ok {
+			return ErrUserNotFound
+		}
+
+		existing, ok := dbStructure.ActorKeys[userId]
+
+		if ok {
+			key = existing
+			return nil
+		}
+
+		dbStructure.ActorKeys[userId] = key
+
+		return nil
+	})
+
+	if err != nil {
+		return ActorKey{}, err
+	}
+
+	return key, nil
+}
+
+// AddRemoteFollower records follower following the user, replacing an
+// earlier follow by the same actor.
+func (db *DB) AddRemoteFollower(userId int, follower RemoteFollower) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[userId]; !ok {
+			return ErrUserNotFound
+		}
+
+		followers := removeRemoteFollower(dbStructure.RemoteFollowers[userId], follower.Actor)
+		follower.Created_At = time.Now().UTC()
+		dbStructure.RemoteFollowers[userId] = append(followers, follower)
+
+		return nil
+	})
+}
+
+func (db *DB) RemoveRemoteFollower(userId int, actor string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		dbStructure.RemoteFollowers[userId] = removeRemoteFollower(dbStructure.RemoteFollowers[userId], actor)
+
+		return nil
+	})
+}
+
+func removeRemoteFollower(followers []RemoteFollower, actor string) []RemoteFollower {
+	kept := []RemoteFollower{}
+
+	for _, follower := range followers {
+		if follower.Actor != actor {
+			kept = append(kept, follower)
+		}
+	}
+
+	return kept
+}
+
+func (db *DB) GetRemoteFollowers(userId int) ([]RemoteFollower, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	followers := dbStructure.RemoteFollowers[userId]
+
+	if followers == nil {
+		followers = []RemoteFollower{}
+	}
+
+	return followers, nil
+}
+
+// AddRemoteLike records like of the chirp, replacing an earlier like by the
+// same actor.
+func (db *DB) AddRemoteLike(chirpId int, like RemoteLike) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpId]
+
+		if !ok || chirp.Id == 0 {
+			return ErrChirpNotFound
+		}
+
+		likes := removeRemoteLike(dbStructure.RemoteLikes[chirpId], like.Actor)
+		like.Created_At = time.Now().UTC()
+		dbStructure.RemoteLikes[chirpId] = append(likes, like)
+
+		return nil
+	})
+}
+
+func (db *DB) RemoveRemoteLike(chirpId int, actor string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		likes := removeRemoteLike(dbStructure.RemoteLikes[chirpId], actor)
+
+		if len(likes) == 0 {
+			delete(dbStructure.RemoteLikes, chirpId)
+		} else {
+			dbStructure.RemoteLikes[chirpId] = likes
+		}
+
+		return nil
+	})
+}
+
+func removeRemoteLike(likes []RemoteLike, actor string) []RemoteLike {
+	kept := []RemoteLike{}
+
+	for _, like := range likes {
+		if like.Actor != actor {
+			kept = append(kept, like)
+		}
+	}
+
+	return kept
+}
+
+// UndoRemoteActivity removes the follow or like by actor whose activity had
+// activityId, for undos that only give the id of what they undo.
+func (db *DB) UndoRemoteActivity(actor, activityId string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		for userId, followers := range dbStructure.RemoteFollowers {
+			for _, follower := range followers {
+				if follower.Actor == actor && follower.Follow_Id == activityId {
+					dbStructure.RemoteFollowers[userId] = removeRemoteFollower(followers, actor)
+				}
+			}
+		}
+
+		for chirpId, likes := range dbStructure.RemoteLikes {
+			for _, like := range likes {
+				if like.Actor == actor && like.Activity_Id == activityId {
+					dbStructure.RemoteLikes[chirpId] = removeRemoteLike(likes, actor)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// RemoveRemoteActor forgets everything from an actor whose account was
+// deleted on its server.
+func (db *DB) RemoveRemoteActor(actor string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		for userId, followers := range dbStructure.RemoteFollowers {
+			dbStructure.RemoteFollowers[userId] = removeRemoteFollower(followers, actor)
+		}
+
+		for chirpId, likes := range dbStructure.RemoteLikes {
+			dbStructure.RemoteLikes[chirpId] = removeRemoteLike(likes, actor)
+		}
+
+		for id, note := range dbStructure.RemoteNotes {
+			if note.Actor == actor {
+				delete(dbStructure.RemoteNotes, id)
+			}
+		}
+
+		return nil
+	})
+}
+
+// SaveRemoteNote stores note, replacing an earlier copy of it.
+func (db *DB) SaveRemoteNote(note RemoteNote) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		existing, ok := dbStructure.RemoteNotes[note.Id]
+
+		if ok && existing.Actor != note.Actor {
+			return errors.New("note belongs to another actor")
+		}
+
+		note.Received_At = time.Now().UTC()
+		dbStructure.RemoteNotes[note.Id] = note
+
+		return nil
+	})
+}
+
+// DeleteRemoteNote deletes the note if it is by actor.
+func (db *DB) DeleteRemoteNote(id, actor string) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		note, ok := dbStructure.RemoteNotes[id]
+
+		if ok && note.Actor == actor {
+			delete(dbStructure.RemoteNotes, id)
+		}
+
+		return nil
+	})
+}
+
+func (db *DB) GetRemoteReplies(chirpId int) ([]RemoteNote, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	replies := []RemoteNote{}
+
+	for _, note := range dbStructure.RemoteNotes {
+		if note.In_Reply_To == chirpId {
+			replies = append(replies, note)
+		}
+	}
+
+	return replies, nil
+}
+
+func (db *DB) GetTombstone(chirpId int) (Tombstone, bool, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return Tombstone{}, false, err
+	}
+
+	tombstone, ok := dbStructure.Tombstones[chirpId]
+
+	return tombstone, ok, nil
+}
+
+func (db *DB) GetTombstones(authorId int) ([]Tombstone, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	tombstones := []Tombstone{}
+
+	for _, tombstone := range dbStructure.Tombstones {
+		if tombstone.Author_Id == authorId {
+			tombstones = append(tombstones, tombstone)
+		}
+	}
+
+	return tombstones, nil
+}
+
+// QueueFederationDeliveries stores deliveries as pending and due now.
+func (db *DB) QueueFederationDeliveries(deliveries []FederationDelivery) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		nextId := 0
+
+		for id := range dbStructure.FederationDeliveries {
+			if id > nextId {
+				nextId = id
+			}
+		}
+
+		now := time.Now().UTC()
+
+		for _, delivery := range deliveries {
+			nextId++
+			delivery.Id = nextId
+			delivery.Status = "pending"
+			delivery.Next_Attempt_At = now
+			delivery.Log = []DeliveryAttempt{}
+			delivery.Created_At = now
+			dbStructure.FederationDeliveries[delivery.Id] = delivery
+		}
+
+		return nil
+	})
+}
+
+func (db *DB) GetFederationDeliveries() ([]FederationDelivery, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]FederationDelivery, 0, len(dbStructure.FederationDeliveries))
+
+	for _, delivery := range dbStructure.FederationDeliveries {
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+// RecordFederationAttempt appends attempt to the delivery's log and moves
+// it to status. Undelivered deliveries are next attempted at nextAttemptAt.
+func (db *DB) RecordFederationAttempt(id int, attempt DeliveryAttempt, status string, nextAttemptAt time.Time) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		delivery, ok := dbStructure.FederationDeliveries[id]
+
+		if !ok {
+			return ErrFederationDeliveryNotFound
+		}
+
+		delivery.Status = status
+		delivery.Attempts++
+		delivery.Log = append(delivery.Log, attempt)
+		delivery.Next_Attempt_At = nextAttemptAt
+
+		if status == "delivered" {
+			deliveredAt := attempt.At
+			delivery.Delivered_At = &deliveredAt
+		}
+
+		dbStructure.FederationDeliveries[id] = delivery
+
+		return nil
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package database
+
+// lockFile is a no-op where flock is unavailable; writes from the CLI and
+// the server are then only safe when they do not overlap.
+func lockFile(path string) (func() error, error) {
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,163 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+var ErrNotificationNotFound = errors.New("notification not found")
+
+type Notification struct {
+	Id         int       `json:"id"`
+	User_Id    int       `json:"user_id"`
+	Type       string    `json:"type"`
+	Actor_Id   int       `json:"actor_id"`
+	Chirp_Id   int       `json:"chirp_id,omitempty"`
+	Report_Id  int       `json:"report_id,omitempty"`
+	Read       bool      `json:"read"`
+	Created_At time.Time `json:"created_at"`
+}
+
+// CreateNotification stores notification unless the recipient would not
+// want it: it is about their own action, they have turned its type off,
+// they have muted the actor, either has blocked the other, or the same
+// notification already exists. created reports whether it was stored.
+func (db *DB) CreateNotification(notification Notification) (stored Notification, created bool, err error) {
+	err = db.update(func(dbStructure *DBStructure) error {
+		recipient, ok := dbStructure.Users[notification.User_Id]
+
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		actorId := notification.Actor_Id
+
+		if actorId == recipient.Id || !recipient.WantsNotification(notification.Type) {
+			return nil
+		}
+
+		if actorId != 0 && (dbStructure.isBlocked(recipient.Id, actorId) || slices.Contains(dbStructure.Mutes[recipient.Id], actorId)) {
+			return nil
+		}
+
+		for _, existing := range dbStructure.Notifications {
+			if existing.User_Id == notification.User_Id && existing.Type == notification.Type && existing.Actor_Id == actorId &&
+				existing.Chirp_Id == notification.Chirp_Id && existing.Report_Id == notification.Report_Id {
+				return nil
+			}
+		}
+
+		notification.Id = len(dbStructure.Notifications) + 1
+		notification.Read = false
+		notification.Created_At = time.Now().UTC()
+		dbStructure.Notifications[notification.Id] = notification
+		stored = notification
+		created = true
+
+		return nil
+	})
+
+	return stored, created, err
+}
+
+func (db *DB) GetNotifications(userId int) ([]Notification, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := []Notification{}
+
+	for _, notification := range dbStructure.Notifications {
+		if notification.User_Id == userId {
+			notifications = append(notifications, notification)
+		}
+	}
+
+	return notifications, nil
+}
+
+func (db *DB) MarkNotificationRead(userId, id int) (Notification, error) {
+	notification := Notification{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		notification, ok = dbStructure.Notifications[id]
+
+		if !ok || notification.User_Id != userId {
+			return ErrNotificationNotFound
+		}
+
+		notification.Read = true
+		dbStructure.Notifications[id] = notification
+
+		return nil
+	})
+
+	if err != nil {
+		return Notification{}, err
+	}
+
+	return notification, nil
+}
+
+// MarkNotificationsRead marks the user's notifications with the given ids
+// read, or all of them when ids is empty, and returns how many were unread.
+// Ids of other users' notifications are ignored.
+func (db *DB) MarkNotificationsRead(userId int, ids []int) (int, error) {
+	marked := 0
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		for id, notification := range dbStructure.Notifications {
+			if notification.User_Id != userId || notification.Read {
+				continue
+			}
+
+			if len(ids) > 0 && !slices.Contains(ids, id) {
+				continue
+			}
+
+			notification.Read = true
+			dbStructure.Notifications[id] = notification
+			marked++
+		}
+
+		return nil
+	})
+
+	return marked, err
+}
+
+// SetNotificationPreferences turns notification types on or off for the
+// user, leaving types not in preferences as they were.
+func (db *DB) SetNotificationPreferences(userId int, preferences map[string]bool) (User, error) {
+	user := User{}
+
+	err := db.modifyUser(userId, func(u *User) {
+		if u.Notification_Preferences == nil {
+			u.Notification_Preferences = map[string]bool{}
+		}
+
+		for notificationType, enabled := range preferences {
+			u.Notification_Preferences[notificationType] = enabled
+		}
+
+		user = *u
+	})
+
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// WantsNotification reports whether the user gets notifications of the type.
+// Types are on unless turned off.
+func (user User) WantsNotification(notificationType string) bool {
+	enabled, ok := user.Notification_Preferences[notificationType]
+
+	return !ok || enabled
+}
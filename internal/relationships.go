@@ -0,0 +1,177 @@
+package database
+
+import (
+	"errors"
+	"slices"
+)
+
+type Relationships struct {
+	Blocking  []int `json:"blocking"`
+	BlockedBy []int `json:"blocked_by"`
+	Muting    []int `json:"muting"`
+}
+
+func (db *DB) BlockUser(blockerId, blockedId int) error {
+	return db.addRelationship("blocks", blockerId, blockedId)
+}
+
+func (db *DB) UnblockUser(blockerId, blockedId int) error {
+	return db.removeRelationship("blocks", blockerId, blockedId)
+}
+
+func (db *DB) MuteUser(muterId, mutedId int) error {
+	return db.addRelationship("mutes", muterId, mutedId)
+}
+
+func (db *DB) UnmuteUser(muterId, mutedId int) error {
+	return db.removeRelationship("mutes", muterId, mutedId)
+}
+
+func (db *DB) FollowUser(followerId, followedId int) error {
+	return db.addRelationship("follows", followerId, followedId)
+}
+
+func (db *DB) UnfollowUser(followerId, followedId int) error {
+	return db.removeRelationship("follows", followerId, followedId)
+}
+
+func (db *DB) GetFollowing(userId int) ([]int, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	following := slices.Clone(dbStructure.Follows[userId])
+
+	if following == nil {
+		following = []int{}
+	}
+
+	return following, nil
+}
+
+func (db *DB) GetFollowers(userId int) ([]int, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	followers := []int{}
+
+	for followerId, following := range dbStructure.Follows {
+		if slices.Contains(following, userId) {
+			followers = append(followers, followerId)
+		}
+	}
+
+	slices.Sort(followers)
+
+	return followers, nil
+}
+
+func (db *DB) GetRelationships(userId int) (Relationships, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return Relationships{}, err
+	}
+
+	relationships := Relationships{
+		Blocking:  slices.Clone(dbStructure.Blocks[userId]),
+		BlockedBy: []int{},
+		Muting:    slices.Clone(dbStructure.Mutes[userId]),
+	}
+
+	for blockerId, blocked := range dbStructure.Blocks {
+		if slices.Contains(blocked, userId) {
+			relationships.BlockedBy = append(relationships.BlockedBy, blockerId)
+		}
+	}
+
+	if relationships.Blocking == nil {
+		relationships.Blocking = []int{}
+	}
+
+	if relationships.Muting == nil {
+		relationships.Muting = []int{}
+	}
+
+	return relationships, nil
+}
+
+func (db *DB) IsBlocked(userId, otherId int) (bool, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return false, err
+	}
+
+	return dbStructure.isBlocked(userId, otherId), nil
+}
+
+func (dbStructure *DBStructure) isBlocked(userId, otherId int) bool {
+	return slices.Contains(dbStructure.Blocks[userId], otherId) || slices.Contains(dbStructure.Blocks[otherId], userId)
+}
+
+func (db *DB) addRelationship(kind string, userId, targetId int) error {
+	if userId == targetId {
+		return errors.New("cannot target yourself")
+	}
+
+	return db.update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[targetId]; !ok {
+			return ErrUserNotFound
+		}
+
+		if kind == "follows" && dbStructure.isBlocked(userId, targetId) {
+			return ErrBlocked
+		}
+
+		relationships := dbStructure.relationshipMap(kind)
+
+		if !slices.Contains(relationships[userId], targetId) {
+			relationships[userId] = append(relationships[userId], targetId)
+		}
+
+		if kind == "blocks" {
+			removeFrom(dbStructure.Follows, userId, targetId)
+			removeFrom(dbStructure.Follows, targetId, userId)
+		}
+
+		return nil
+	})
+}
+
+func (db *DB) removeRelationship(kind string, userId, targetId int) error {
+	return db.update(func(dbStructure *DBStructure) error {
+		removeFrom(dbStructure.relationshipMap(kind), userId, targetId)
+		return nil
+	})
+}
+
+func removeFrom(relationships map[int][]int, userId, targetId int) {
+	i := slices.Index(relationships[userId], targetId)
+
+	if i == -1 {
+		return
+	}
+
+	relationships[userId] = slices.Delete(relationships[userId], i, i+1)
+
+	if len(relationships[userId]) == 0 {
+		delete(relationships, userId)
+	}
+}
+
+func (dbStructure *DBStructure) relationshipMap(kind string) map[int][]int {
+	switch kind {
+	case "mutes":
+		return dbStructure.Mutes
+	case "follows":
+		return dbStructure.Follows
+	}
+
+	return dbStructure.Blocks
+}
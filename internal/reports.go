@@ -0,0 +1,252 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrReportNotFound = errors.New("report not found")
+var ErrReportResolved = errors.New("report already resolved")
+var ErrAlreadyReported = errors.New("target already reported")
+var ErrReportNotChirp = errors.New("only reported chirps can be removed")
+
+type Report struct {
+	Id          int            `json:"id"`
+	Reporter_Id int            `json:"reporter_id"`
+	Target_Type string         `json:"target_type"`
+	Target_Id   int            `json:"target_id"`
+	Category    string         `json:"category"`
+	Details     string         `json:"details,omitempty"`
+	Status      string         `json:"status"`
+	Assignee_Id int            `json:"assignee_id,omitempty"`
+	Resolution  string         `json:"resolution,omitempty"`
+	Actions     []ReportAction `json:"actions"`
+	Created_At  time.Time      `json:"created_at"`
+	Updated_At  time.Time      `json:"updated_at"`
+}
+
+// ReportAction is one entry in a report's audit trail. An Actor_Id of 0 is
+// the system, such as the content filter.
+type ReportAction struct {
+	Actor_Id   int       `json:"actor_id"`
+	Action     string    `json:"action"`
+	Note       string    `json:"note,omitempty"`
+	Created_At time.Time `json:"created_at"`
+}
+
+// CreateReport opens a report against a chirp or user. A reporter may only
+// have one open report per target; system reports (Reporter_Id 0) are not
+// limited.
+func (db *DB) CreateReport(report Report) (Report, error) {
+	err := db.update(func(dbStructure *DBStructure) error {
+		switch report.Target_Type {
+		case "chirp":
+			if chirp, ok := dbStructure.Chirps[report.Target_Id]; !ok || chirp.Id == 0 {
+				return ErrChirpNotFound
+			}
+		case "user":
+			if _, ok := dbStructure.Users[report.Target_Id]; !ok {
+				return ErrUserNotFound
+			}
+		default:
+			return errors.New("unknown report target")
+		}
+
+		for _, existing := range dbStructure.Reports {
+			if report.Reporter_Id != 0 && existing.Reporter_Id == report.Reporter_Id && existing.Status == "open" &&
+				existing.Target_Type == report.Target_Type && existing.Target_Id == report.Target_Id {
+				return ErrAlreadyReported
+			}
+		}
+
+		now := time.Now().UTC()
+		report.Id = len(dbStructure.Reports) + 1
+		report.Status = "open"
+		report.Actions = []ReportAction{{Actor_Id: report.Reporter_Id, Action: "opened", Note: report.Details, Created_At: now}}
+		report.Created_At = now
+		report.Updated_At = now
+		dbStructure.Reports[report.Id] = report
+
+		return nil
+	})
+
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+func (db *DB) GetReport(id int) (Report, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return Report{}, err
+	}
+
+	report, ok := dbStructure.Reports[id]
+
+	if !ok {
+		return Report{}, ErrReportNotFound
+	}
+
+	return report, nil
+}
+
+func (db *DB) GetReports() ([]Report, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]Report, 0, len(dbStructure.Reports))
+
+	for _, report := range dbStructure.Reports {
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+func (db *DB) AssignReport(id, actorId, assigneeId int) (Report, error) {
+	return db.updateReport(id, func(dbStructure *DBStructure, report *Report) error {
+		if _, ok := dbStructure.Users[assigneeId]; !ok && assigneeId != 0 {
+			return ErrUserNotFound
+		}
+
+		report.Assignee_Id = assigneeId
+		report.appendAction(actorId, "assigned", "")
+
+		return nil
+	})
+}
+
+// ResolveReport closes an open report. A removed resolution also deletes the
+// reported chirp, and a suspended one suspends the reported user or the
+// chirp's author once canSuspend allows it. The action happens in the same
+// update as the status change, so a report is only ever acted on once. The
+// removed chirp, if any, is returned with the report.
+func (db *DB) ResolveReport(id, actorId int, resolution, note string, canSuspend func(actor, target User) error) (Report, Chirp, error) {
+	removed := Chirp{}
+
+	report, err := db.updateReport(id, func(dbStructure *DBStructure, report *Report) error {
+		var err error
+
+		switch resolution {
+		case "removed":
+			if report.Target_Type != "chirp" {
+				return ErrReportNotChirp
+			}
+
+			removed, err = dbStructure.deleteChirp(report.Target_Id)
+		case "suspended":
+			err = dbStructure.suspendReported(*report, actorId, note, canSuspend)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		report.Status = "resolved"
+		report.Resolution = resolution
+		report.appendAction(actorId, resolution, note)
+
+		return nil
+	})
+
+	if err != nil {
+		return Report{}, Chirp{}, err
+	}
+
+	if removed.Id != 0 {
+		db.chirpDeleted(removed)
+	}
+
+	return report, removed, nil
+}
+
+// suspendReported suspends the reported user, or the author of the reported
+// chirp.
+func (dbStructure *DBStructure) suspendReported(report Report, actorId int, note string, canSuspend func(actor, target User) error) error {
+	userId := report.Target_Id
+
+	if report.Target_Type == "chirp" {
+		chirp, ok := dbStructure.Chirps[report.Target_Id]
+
+		if !ok || chirp.Id == 0 {
+			return ErrChirpNotFound
+		}
+
+		userId = chirp.Author_Id
+	}
+
+	actor, ok := dbStructure.Users[actorId]
+
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	target, ok := dbStructure.Users[userId]
+
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	err := canSuspend(actor, target)
+
+	if err != nil {
+		return err
+	}
+
+	target.Is_Suspended = true
+	target.Suspension = fmt.Sprintf("Suspended following a report for %s", report.Category)
+
+	if note != "" {
+		target.Suspension += ": " + note
+	}
+
+	dbStructure.Users[userId] = target
+
+	return nil
+}
+
+func (db *DB) updateReport(id int, change func(dbStructure *DBStructure, report *Report) error) (Report, error) {
+	report := Report{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		report, ok = dbStructure.Reports[id]
+
+		if !ok {
+			return ErrReportNotFound
+		}
+
+		if report.Status != "open" {
+			return ErrReportResolved
+		}
+
+		err := change(dbStructure, &report)
+
+		if err != nil {
+			return err
+		}
+
+		dbStructure.Reports[id] = report
+
+		return nil
+	})
+
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+func (report *Report) appendAction(actorId int, action, note string) {
+	now := time.Now().UTC()
+	report.Actions = append(report.Actions, ReportAction{Actor_Id: actorId, Action: action, Note: note, Created_At: now})
+	report.Updated_At = now
+}
@@ -0,0 +1,311 @@
+package database
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type SearchQuery struct {
+	Terms     []string
+	Phrases   [][]string
+	Hashtags  []string
+	Author_Id int
+	Since     time.Time
+	Until     time.Time
+}
+
+type SearchResult struct {
+	Chirp Chirp
+	Score float64
+}
+
+// searchIndex is an in-memory inverted index over chirp bodies. It is built
+// from the database file when the DB is opened and kept current by the
+// chirp mutation methods.
+type searchIndex struct {
+	mux      *sync.RWMutex
+	postings map[string]map[int]int
+	docs     map[int][]string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		mux:      &sync.RWMutex{},
+		postings: map[string]map[int]int{},
+		docs:     map[int][]string{},
+	}
+}
+
+func (index *searchIndex) add(chirp Chirp) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.removeLocked(chirp.Id)
+
+	if chirp.Id == 0 {
+		return
+	}
+
+	terms := Tokenize(chirp.Body)
+	index.docs[chirp.Id] = terms
+
+	for _, term := range terms {
+		if index.postings[term] == nil {
+			index.postings[term] = map[int]int{}
+		}
+
+		index.postings[term][chirp.Id]++
+	}
+}
+
+func (index *searchIndex) remove(chirpId int) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.removeLocked(chirpId)
+}
+
+func (index *searchIndex) removeLocked(chirpId int) {
+	for _, term := range index.docs[chirpId] {
+		delete(index.postings[term], chirpId)
+
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+
+	delete(index.docs, chirpId)
+}
+
+// score ranks every indexed chirp containing all of terms with BM25. With no
+// terms every chirp matches with a score of zero.
+func (index *searchIndex) score(terms []string) map[int]float64 {
+	index.mux.RLock()
+	defer index.mux.RUnlock()
+
+	const k1 = 1.2
+	const b = 0.75
+
+	scores := map[int]float64{}
+
+	if len(terms) == 0 {
+		for id := range index.docs {
+			scores[id] = 0
+		}
+
+		return scores
+	}
+
+	totalLength := 0
+
+	for _, doc := range index.docs {
+		totalLength += len(doc)
+	}
+
+	docCount := float64(len(index.docs))
+	averageLength := float64(totalLength) / max(docCount, 1)
+
+	for i, term := range terms {
+		postings := index.postings[term]
+		idf := math.Log(1 + (docCount-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		matched := map[int]float64{}
+
+		for id, frequency := range postings {
+			if _, ok := scores[id]; i > 0 && !ok {
+				continue
+			}
+
+			tf := float64(frequency)
+			length := float64(len(index.docs[id]))
+			matched[id] = scores[id] + idf*tf*(k1+1)/(tf+k1*(1-b+b*length/averageLength))
+		}
+
+		scores = matched
+	}
+
+	return scores
+}
+
+func (index *searchIndex) containsPhrase(chirpId int, phrase []string) bool {
+	index.mux.RLock()
+	defer index.mux.RUnlock()
+
+	doc := index.docs[chirpId]
+
+	for start := 0; start+len(phrase) <= len(doc); start++ {
+		matched := true
+
+		for i, term := range phrase {
+			if doc[start+i] != term {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (db *DB) SearchChirps(query SearchQuery) ([]SearchResult, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	terms := append([]string{}, query.Terms...)
+
+	for _, phrase := range query.Phrases {
+		terms = append(terms, phrase...)
+	}
+
+	results := []SearchResult{}
+
+	for id, score := range db.index.score(terms) {
+		chirp, ok := dbStructure.Chirps[id]
+
+		if !ok || chirp.Id == 0 || !query.matches(chirp) {
+			continue
+		}
+
+		phrasesMatched := true
+
+		for _, phrase := range query.Phrases {
+			if !db.index.containsPhrase(id, phrase) {
+				phrasesMatched = false
+				break
+			}
+		}
+
+		if phrasesMatched {
+			results = append(results, SearchResult{Chirp: chirp, Score: score})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+
+		return results[i].Chirp.Id > results[j].Chirp.Id
+	})
+
+	return results, nil
+}
+
+func (query SearchQuery) matches(chirp Chirp) bool {
+	if query.Author_Id != 0 && chirp.Author_Id != query.Author_Id {
+		return false
+	}
+
+	if !query.Since.IsZero() && chirp.Created_At.Before(query.Since) {
+		return false
+	}
+
+	if !query.Until.IsZero() && !chirp.Created_At.Before(query.Until) {
+		return false
+	}
+
+	for _, tag := range query.Hashtags {
+		found := false
+
+		for _, entity := range chirp.Entities {
+			if entity.Type == "hashtag" && entity.Value == strings.ToLower(tag) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (db *DB) SearchUsers(q string) ([]User, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	q = strings.ToLower(strings.TrimPrefix(q, "@"))
+	users := []User{}
+
+	if q == "" {
+		return users, nil
+	}
+
+	for _, user := range dbStructure.Users {
+		if strings.Contains(strings.ToLower(user.Handle), q) {
+			users = append(users, user)
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+
+	return users, nil
+}
+
+// Tokenize splits text into lowercased, stemmed search terms.
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	terms := make([]string, 0, len(words))
+
+	for _, word := range words {
+		terms = append(terms, stem(word))
+	}
+
+	return terms
+}
+
+// stem strips common English inflections so that, for example, "running",
+// "runs" and "run" share a term. It is deliberately much lighter than a full
+// Porter stemmer.
+func stem(word string) string {
+	if len(word) <= 3 {
+		return word
+	}
+
+	switch {
+	case strings.HasSuffix(word, "ies") && len(word) > 4:
+		word = word[:len(word)-3] + "y"
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") && !strings.HasSuffix(word, "us"):
+		word = word[:len(word)-1]
+	}
+
+	for _, suffix := range []string{"ingly", "edly", "ing", "ed", "ly"} {
+		trimmed, found := strings.CutSuffix(word, suffix)
+
+		if !found || len(trimmed) < 3 || strings.IndexAny(trimmed, "aeiouy") == -1 {
+			continue
+		}
+
+		word = trimmed
+
+		if n := len(word); n > 2 && word[n-1] == word[n-2] && !strings.ContainsRune("lsz", rune(word[n-1])) {
+			word = word[:n-1]
+		}
+
+		break
+	}
+
+	return word
+}
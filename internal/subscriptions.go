@@ -0,0 +1,101 @@
+package database
+
+import (
+	"time"
+)
+
+// legacyPlan and legacyPeriod make up the subscription given to users
+// upgraded before subscriptions were tracked.
+const (
+	legacyPlan   = "chirpy_red"
+	legacyPeriod = 30 * 24 * time.Hour
+)
+
+// Subscription is the user's paid plan. Source says where the current period
+// came from: "polka" for payments, "admin" for grants by an administrator and
+// "chirpy" for periods set by Chirpy itself. Last_Event_At is when the last
+// Polka event applied to it happened, so older ones arriving late can be
+// ignored.
+type Subscription struct {
+	Plan               string               `json:"plan,omitempty"`
+	Source             string               `json:"source,omitempty"`
+	Status             string               `json:"status,omitempty"`
+	Current_Period_End *time.Time           `json:"current_period_end,omitempty"`
+	Last_Event_At      *time.Time           `json:"last_event_at,omitempty"`
+	History            []SubscriptionChange `json:"history,omitempty"`
+}
+
+type SubscriptionChange struct {
+	Event              string     `json:"event"`
+	Plan               string     `json:"plan"`
+	Source             string     `json:"source,omitempty"`
+	Status             string     `json:"status"`
+	Current_Period_End *time.Time `json:"current_period_end,omitempty"`
+	Created_At         time.Time  `json:"created_at"`
+}
+
+// Entitled reports whether the subscription grants the paid plan. Past due
+// subscriptions keep it until they expire.
+func (subscription Subscription) Entitled() bool {
+	return subscription.Status == "active" || subscription.Status == "past_due"
+}
+
+// UpdateSubscription applies change to the user's subscription and keeps
+// Is_Chirpy_Red in step with it.
+func (db *DB) UpdateSubscription(userId int, change func(subscription *Subscription) error) (User, error) {
+	user := User{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[userId]
+
+		if !ok {
+			return ErrUserNotFound
+		}
+
+		err := change(&user.Subscription)
+
+		if err != nil {
+			return err
+		}
+
+		user.Is_Chirpy_Red = user.Subscription.Entitled()
+		dbStructure.Users[userId] = user
+
+		return nil
+	})
+
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// migrateLegacySubscriptions gives users upgraded before subscriptions were
+// tracked an active subscription for one period from now, so they expire
+// like everyone else unless Polka renews them.
+func (dbStructure *DBStructure) migrateLegacySubscriptions(now time.Time) {
+	for id, user := range dbStructure.Users {
+		if !user.Is_Chirpy_Red || user.Subscription.Status != "" {
+			continue
+		}
+
+		end := now.Add(legacyPeriod)
+		user.Subscription = Subscription{
+			Plan:               legacyPlan,
+			Source:             "chirpy",
+			Status:             "active",
+			Current_Period_End: &end,
+			History: []SubscriptionChange{{
+				Event:              "subscription.migrated",
+				Plan:               legacyPlan,
+				Source:             "chirpy",
+				Status:             "active",
+				Current_Period_End: &end,
+				Created_At:         now,
+			}},
+		}
+		dbStructure.Users[id] = user
+	}
+}
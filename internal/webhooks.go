@@ -0,0 +1,160 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrWebhookEventNotFound = errors.New("webhook event not found")
+var ErrWebhookEventBusy = errors.New("webhook event is already being processed")
+
+// WebhookEvent is an inbound webhook as received from a provider, keyed by
+// the provider's event id so retried deliveries are only applied once.
+type WebhookEvent struct {
+	Id              string          `json:"id"`
+	Provider        string          `json:"provider"`
+	Type            string          `json:"type"`
+	Payload         json.RawMessage `json:"payload"`
+	Status          string          `json:"status"`
+	Attempts        int             `json:"attempts"`
+	Last_Error      string          `json:"last_error,omitempty"`
+	Received_At     time.Time       `json:"received_at"`
+	Last_Attempt_At *time.Time      `json:"last_attempt_at,omitempty"`
+	Lease_Until     *time.Time      `json:"lease_until,omitempty"`
+	Processed_At    *time.Time      `json:"processed_at,omitempty"`
+}
+
+// ReceiveWebhookEvent stores event as pending unless an event with the same
+// id was already received, in which case the stored event is returned and
+// received is false.
+func (db *DB) ReceiveWebhookEvent(event WebhookEvent) (stored WebhookEvent, received bool, err error) {
+	err = db.update(func(dbStructure *DBStructure) error {
+		if existing, ok := dbStructure.WebhookEvents[event.Id]; ok {
+			stored = existing
+			return nil
+		}
+
+		event.Status = "pending"
+		event.Received_At = time.Now().UTC()
+		dbStructure.WebhookEvents[event.Id] = event
+		stored = event
+		received = true
+
+		return nil
+	})
+
+	return stored, received, err
+}
+
+// ClaimWebhookEvent marks the event processing for lease, so no other attempt
+// starts on it meanwhile. Only events with one of statuses can be claimed,
+// and processing ones whose lease has run out, as their attempt was lost.
+func (db *DB) ClaimWebhookEvent(id string, statuses []string, lease time.Duration) (WebhookEvent, error) {
+	event := WebhookEvent{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		event, ok = dbStructure.WebhookEvents[id]
+
+		if !ok {
+			return ErrWebhookEventNotFound
+		}
+
+		now := time.Now().UTC()
+		claimable := event.Status == "processing" && event.Lease_Until != nil && now.After(*event.Lease_Until)
+
+		if claimable {
+			event.Attempts++
+			event.Last_Error = "attempt did not finish"
+		}
+
+		for _, status := range statuses {
+			claimable = claimable || event.Status == status
+		}
+
+		if !claimable {
+			return ErrWebhookEventBusy
+		}
+
+		leaseUntil := now.Add(lease)
+		event.Status = "processing"
+		event.Lease_Until = &leaseUntil
+		dbStructure.WebhookEvents[id] = event
+
+		return nil
+	})
+
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return event, nil
+}
+
+// FinishWebhookEvent records the outcome of an attempt to apply the event.
+func (db *DB) FinishWebhookEvent(id, status, lastError string) (WebhookEvent, error) {
+	event := WebhookEvent{}
+
+	err := db.update(func(dbStructure *DBStructure) error {
+		var ok bool
+		event, ok = dbStructure.WebhookEvents[id]
+
+		if !ok {
+			return ErrWebhookEventNotFound
+		}
+
+		now := time.Now().UTC()
+		event.Status = status
+		event.Attempts++
+		event.Last_Error = lastError
+		event.Last_Attempt_At = &now
+		event.Lease_Until = nil
+
+		if status != "failed" {
+			event.Processed_At = &now
+		}
+
+		dbStructure.WebhookEvents[id] = event
+
+		return nil
+	})
+
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return event, nil
+}
+
+func (db *DB) GetWebhookEvent(id string) (WebhookEvent, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	event, ok := dbStructure.WebhookEvents[id]
+
+	if !ok {
+		return WebhookEvent{}, ErrWebhookEventNotFound
+	}
+
+	return event, nil
+}
+
+func (db *DB) GetWebhookEvents() ([]WebhookEvent, error) {
+	dbStructure, err := db.loadDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]WebhookEvent, 0, len(dbStructure.WebhookEvents))
+
+	for _, event := range dbStructure.WebhookEvents {
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	database "github.com/nicholasdavolt/chirpy/internal"
@@ -15,18 +19,103 @@ type apiConfig struct {
 	JwtSecret         string
 	DefaultExpiration int
 	RefreshExpiration int
-	Polka_Key         string
+	Polka             *polkaVerifier
+	Trends            *trendAggregator
+	Filter            *contentFilter
+	Entitlements      *entitlementStore
+	ChirpLimiter      *rateLimiter
+	Audit             *database.AuditLog
+	Webhooks          *webhookDispatcher
+	Hub               *hub
+	Federation        *federation
+	// BaseURL is where the server is reachable, for links in feeds. When it
+	// is empty links are made from the request's host.
+	BaseURL string
 }
 
 func main() {
 
 	godotenv.Load()
+
+	dbPath := os.Getenv("DATABASE_PATH")
+
+	if dbPath == "" {
+		dbPath = "database.json"
+	}
+
+	auditPath := os.Getenv("AUDIT_LOG_PATH")
+
+	if auditPath == "" {
+		auditPath = "audit.log"
+	}
+
+	auditLog, err := database.OpenAuditLog(auditPath)
+
+	if err != nil {
+		log.Fatalf("AUDIT ERROR %s", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		db, err := database.NewDB(dbPath)
+
+		if err == nil {
+			err = runAdmin(db, auditLog, os.Args[2:], os.Stdout)
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	jwtSecret := os.Getenv("JWT_SECRET")
 	polkaKey := os.Getenv("POLKA_KEY")
+	polkaTolerance, err := strconv.Atoi(os.Getenv("POLKA_SIGNATURE_TOLERANCE"))
+
+	if err != nil {
+		polkaTolerance = 300
+	}
+
+	filterPath := os.Getenv("FILTER_FILE")
+
+	if filterPath == "" {
+		filterPath = "filters.json"
+	}
+
+	filter, err := newContentFilter(filterPath)
+
+	if err != nil {
+		log.Printf("FILTER ERROR %s", err)
+	}
+
+	go watchFile(filterPath, 5*time.Second, filter.Reload)
+
+	entitlementsPath := os.Getenv("ENTITLEMENTS_FILE")
+
+	if entitlementsPath == "" {
+		entitlementsPath = "entitlements.json"
+	}
+
+	entitlements, err := newEntitlementStore(entitlementsPath)
+
+	if err != nil {
+		log.Printf("ENTITLEMENTS ERROR %s", err)
+	}
+
+	go watchFile(entitlementsPath, 5*time.Second, entitlements.Reload)
+
 	const filepathRoot = "."
 	const port = "8080"
 
-	db, err := database.NewDB("database.json")
+	db, err := database.NewDB(dbPath)
+
+	if err != nil {
+		log.Printf("DB ERROR %s", err)
+	}
+
+	dbChirps, err := db.GetChirps()
 
 	if err != nil {
 		log.Printf("DB ERROR %s", err)
@@ -39,7 +128,25 @@ func main() {
 		JwtSecret:         jwtSecret,
 		DefaultExpiration: 3600,
 		RefreshExpiration: 5184000,
-		Polka_Key:         polkaKey,
+		Polka:             newPolkaVerifier(strings.Split(os.Getenv("POLKA_WEBHOOK_SECRETS"), ","), polkaKey, os.Getenv("POLKA_ALLOW_API_KEY") == "true", time.Duration(polkaTolerance)*time.Second),
+		Trends:            newTrendAggregator(dbChirps),
+		Filter:            filter,
+		Entitlements:      entitlements,
+		ChirpLimiter:      newRateLimiter(),
+		Audit:             auditLog,
+		Webhooks:          newWebhookDispatcher(),
+		Hub:               newHub(),
+		Federation:        newFederation(os.Getenv("FEDERATION_ALLOW_PRIVATE") == "true"),
+		BaseURL:           strings.TrimSuffix(os.Getenv("BASE_URL"), "/"),
+	}
+
+	go apiCFG.retryWebhookEvents(time.Minute)
+	go apiCFG.expireSubscriptions(time.Minute)
+	go apiCFG.deliverWebhooks(10 * time.Second)
+	go apiCFG.relayChirpEvents()
+
+	if apiCFG.BaseURL != "" {
+		go apiCFG.deliverActivities(10 * time.Second)
 	}
 
 	srv := &http.Server{
@@ -49,18 +156,101 @@ func main() {
 
 	mux.Handle("/app/*", http.StripPrefix("/app", apiCFG.middlewareMetricsInc(http.FileServer(http.Dir(filepathRoot)))))
 	mux.HandleFunc("GET /api/healthz", handlerReadiness)
-	mux.HandleFunc("GET /admin/metrics", apiCFG.handlerHits)
-	mux.HandleFunc("GET /api/reset", apiCFG.handlerMetricReset)
+	mux.HandleFunc("GET /admin/metrics", apiCFG.requireRole(roleAdmin, apiCFG.handlerHits))
+	mux.HandleFunc("GET /api/reset", apiCFG.requireRole(roleAdmin, apiCFG.handlerMetricReset))
+	mux.HandleFunc("GET /admin/filters", apiCFG.requireRole(roleAdmin, apiCFG.handlerGetFilters))
+	mux.HandleFunc("PUT /admin/filters", apiCFG.requireRole(roleAdmin, apiCFG.handlerSetFilter))
+	mux.HandleFunc("DELETE /admin/filters/{word}", apiCFG.requireRole(roleAdmin, apiCFG.handlerDeleteFilter))
+	mux.HandleFunc("POST /admin/filters/reload", apiCFG.requireRole(roleAdmin, apiCFG.handlerReloadFilters))
+	mux.HandleFunc("GET /admin/users", apiCFG.requireRole(roleAdmin, apiCFG.handlerAdminGetUsers))
+	mux.HandleFunc("GET /admin/users/{id}", apiCFG.requireRole(roleAdmin, apiCFG.handlerAdminGetUser))
+	mux.HandleFunc("PUT /admin/users/{id}/role", apiCFG.requireRole(roleAdmin, apiCFG.handlerAdminSetRole))
+	mux.HandleFunc("POST /admin/users/{id}/chirpy-red", apiCFG.requireRole(roleAdmin, apiCFG.handlerAdminGrantChirpyRed))
+	mux.HandleFunc("DELETE /admin/users/{id}/chirpy-red", apiCFG.requireRole(roleAdmin, apiCFG.handlerAdminRevokeChirpyRed))
+	mux.HandleFunc("POST /admin/users/{id}/suspension", apiCFG.requireRole(roleAdmin, apiCFG.handlerAdminSuspendUser))
+	mux.HandleFunc("DELETE /admin/users/{id}/suspension", apiCFG.requireRole(roleAdmin, apiCFG.handlerAdminUnsuspendUser))
+	mux.HandleFunc("POST /admin/users/{id}/password-reset", apiCFG.requireRole(roleAdmin, apiCFG.handlerAdminResetPassword))
+	mux.HandleFunc("POST /admin/users/{id}/revoke-sessions", apiCFG.requireRole(roleAdmin, apiCFG.handlerAdminRevokeSessions))
+	mux.HandleFunc("GET /admin/audit", apiCFG.requireRole(roleAdmin, apiCFG.handlerGetAudit))
+	mux.HandleFunc("GET /admin/audit/export", apiCFG.requireRole(roleAdmin, apiCFG.handlerExportAudit))
+	mux.HandleFunc("GET /admin/audit/verify", apiCFG.requireRole(roleAdmin, apiCFG.handlerVerifyAudit))
+	mux.HandleFunc("GET /admin/webhooks", apiCFG.requireRole(roleAdmin, apiCFG.handlerGetWebhookEvents))
+	mux.HandleFunc("GET /admin/webhooks/{id}", apiCFG.requireRole(roleAdmin, apiCFG.handlerGetWebhookEvent))
+	mux.HandleFunc("POST /admin/webhooks/{id}/replay", apiCFG.requireRole(roleAdmin, apiCFG.handlerReplayWebhookEvent))
+	mux.HandleFunc("GET /admin/entitlements", apiCFG.requireRole(roleAdmin, apiCFG.handlerGetPlans))
+	mux.HandleFunc("POST /admin/entitlements/reload", apiCFG.requireRole(roleAdmin, apiCFG.handlerReloadEntitlements))
+	mux.HandleFunc("GET /admin/reports", apiCFG.requireRole(roleModerator, apiCFG.handlerGetReports))
+	mux.HandleFunc("GET /admin/reports/{id}", apiCFG.requireRole(roleModerator, apiCFG.handlerGetReport))
+	mux.HandleFunc("POST /admin/reports/{id}/assign", apiCFG.requireRole(roleModerator, apiCFG.handlerAssignReport))
+	mux.HandleFunc("POST /admin/reports/{id}/resolve", apiCFG.requireRole(roleModerator, apiCFG.handlerResolveReport))
 	mux.HandleFunc("POST /api/refresh", apiCFG.handlerTokenRefresh)
 	mux.HandleFunc("POST /api/revoke", apiCFG.handlerTokenRevoke)
 	mux.HandleFunc("POST /api/chirps", apiCFG.handlerChirpReceive)
 	mux.HandleFunc("GET /api/chirps", apiCFG.handlerGetChirps)
 	mux.HandleFunc("DELETE /api/chirps/{id}", apiCFG.handlerDeleteChirp)
 	mux.HandleFunc("GET /api/chirps/{id}", apiCFG.handlerGetChirp)
+	mux.HandleFunc("PUT /api/chirps/{id}", apiCFG.handlerEditChirp)
+	mux.HandleFunc("GET /api/chirps/{id}/history", apiCFG.handlerGetChirpHistory)
+	mux.HandleFunc("GET /api/chirps/{id}/replies", apiCFG.handlerGetReplies)
+	mux.HandleFunc("GET /api/chirps/{id}/thread", apiCFG.handlerGetThread)
+	mux.HandleFunc("GET /api/chirps/{id}/quotes", apiCFG.handlerGetQuotes)
+	mux.HandleFunc("POST /api/chirps/{id}/like", apiCFG.handlerLikeChirp)
+	mux.HandleFunc("DELETE /api/chirps/{id}/like", apiCFG.handlerUnlikeChirp)
+	mux.HandleFunc("GET /api/chirps/{id}/likes", apiCFG.handlerGetLikes)
+	mux.HandleFunc("POST /api/chirps/{id}/rechirp", apiCFG.handlerRechirp)
+	mux.HandleFunc("DELETE /api/chirps/{id}/rechirp", apiCFG.handlerUnrechirp)
+	mux.HandleFunc("GET /api/timeline", apiCFG.handlerGetTimeline)
+	mux.HandleFunc("GET /api/stream", apiCFG.handlerStream)
+	mux.HandleFunc("GET /api/ws", apiCFG.handlerWebSocket)
+	mux.HandleFunc("GET /api/hashtags/{tag}/chirps", apiCFG.handlerGetHashtagChirps)
+	mux.HandleFunc("GET /users/{id}/feed.rss", apiCFG.handlerUserFeed("rss"))
+	mux.HandleFunc("GET /users/{id}/feed.atom", apiCFG.handlerUserFeed("atom"))
+	mux.HandleFunc("GET /users/{id}/feed.json", apiCFG.handlerUserFeed("json"))
+	mux.HandleFunc("GET /hashtags/{tag}/feed.rss", apiCFG.handlerHashtagFeed("rss"))
+	mux.HandleFunc("GET /hashtags/{tag}/feed.atom", apiCFG.handlerHashtagFeed("atom"))
+	mux.HandleFunc("GET /hashtags/{tag}/feed.json", apiCFG.handlerHashtagFeed("json"))
+	mux.HandleFunc("GET /api/notifications", apiCFG.handlerGetNotifications)
+	mux.HandleFunc("GET /api/notifications/unread", apiCFG.handlerGetUnreadCount)
+	mux.HandleFunc("POST /api/notifications/read", apiCFG.handlerMarkNotificationsRead)
+	mux.HandleFunc("POST /api/notifications/{id}/read", apiCFG.handlerMarkNotificationRead)
+	mux.HandleFunc("GET /api/search", apiCFG.handlerSearch)
+	mux.HandleFunc("GET /api/trends", apiCFG.handlerGetTrends)
+	mux.HandleFunc("POST /api/reports", apiCFG.handlerCreateReport)
 	mux.HandleFunc("POST /api/users", apiCFG.handlerUserCreate)
 	mux.HandleFunc("PUT /api/users", apiCFG.handlerUserPut)
+	mux.HandleFunc("GET /api/users/me/subscription", apiCFG.handlerGetSubscription)
+	mux.HandleFunc("GET /api/users/me/entitlements", apiCFG.handlerGetEntitlements)
+	mux.HandleFunc("GET /api/users/me/notification-preferences", apiCFG.handlerGetNotificationPreferences)
+	mux.HandleFunc("PUT /api/users/me/notification-preferences", apiCFG.handlerSetNotificationPreferences)
 	mux.HandleFunc("POST /api/login", apiCFG.handlerLoginPost)
+	mux.HandleFunc("POST /api/password-reset", apiCFG.handlerPasswordReset)
 	mux.HandleFunc("POST /api/polka/webhooks", apiCFG.handlerPolkaPost)
+	mux.HandleFunc("POST /api/webhooks", apiCFG.handlerCreateWebhookEndpoint)
+	mux.HandleFunc("GET /api/webhooks", apiCFG.handlerGetWebhookEndpoints)
+	mux.HandleFunc("DELETE /api/webhooks/{id}", apiCFG.handlerDeleteWebhookEndpoint)
+	mux.HandleFunc("GET /api/webhooks/{id}/deliveries", apiCFG.handlerGetWebhookDeliveries)
+	mux.HandleFunc("POST /api/webhooks/{id}/deliveries/{deliveryId}/redeliver", apiCFG.handlerRedeliverWebhook)
+	mux.HandleFunc("GET /api/blocks", apiCFG.handlerGetBlocks)
+	mux.HandleFunc("GET /api/mutes", apiCFG.handlerGetMutes)
+	mux.HandleFunc("POST /api/users/{id}/block", apiCFG.handlerBlockUser)
+	mux.HandleFunc("DELETE /api/users/{id}/block", apiCFG.handlerUnblockUser)
+	mux.HandleFunc("POST /api/users/{id}/mute", apiCFG.handlerMuteUser)
+	mux.HandleFunc("DELETE /api/users/{id}/mute", apiCFG.handlerUnmuteUser)
+	mux.HandleFunc("POST /api/users/{id}/follow", apiCFG.handlerFollowUser)
+	mux.HandleFunc("DELETE /api/users/{id}/follow", apiCFG.handlerUnfollowUser)
+
+	// Federation ids are built from BASE_URL rather than the request, so
+	// federation is off without it.
+	if apiCFG.BaseURL != "" {
+		mux.HandleFunc("GET /.well-known/webfinger", apiCFG.handlerWebFinger)
+		mux.HandleFunc("GET /users/{id}", apiCFG.handlerGetActor)
+		mux.HandleFunc("GET /users/{id}/outbox", apiCFG.handlerGetOutbox)
+		mux.HandleFunc("GET /users/{id}/followers", apiCFG.handlerGetFollowers)
+		mux.HandleFunc("POST /users/{id}/inbox", apiCFG.handlerInbox)
+		mux.HandleFunc("POST /inbox", apiCFG.handlerInbox)
+		mux.HandleFunc("GET /chirps/{id}", apiCFG.handlerGetNote)
+		mux.HandleFunc("GET /api/chirps/{id}/remote-replies", apiCFG.handlerGetRemoteReplies)
+	}
 
 	log.Printf("Serving on port: %s\n", port)
 
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+var notificationTypes = []string{"mention", "reply", "quote", "follow", "like", "rechirp", "report_resolved"}
+
+// notificationVerbs completes the summary of a notification after the
+// actors, as in "@alice liked your chirp".
+var notificationVerbs = map[string]string{
+	"mention": "mentioned you",
+	"reply":   "replied to your chirp",
+	"quote":   "quoted your chirp",
+	"follow":  "followed you",
+	"like":    "liked your chirp",
+	"rechirp": "rechirped your chirp",
+}
+
+// groupedNotificationTypes are grouped per chirp, and follows all together,
+// so many likes of one chirp read as "5 people liked your chirp".
+var groupedNotificationTypes = map[string]bool{
+	"follow":  true,
+	"like":    true,
+	"rechirp": true,
+}
+
+// NotificationGroup is a set of notifications of one type about the same
+// chirp, newest first. Its id and time are those of the newest.
+type NotificationGroup struct {
+	Id               int       `json:"id"`
+	Type             string    `json:"type"`
+	Chirp_Id         int       `json:"chirp_id,omitempty"`
+	Report_Id        int       `json:"report_id,omitempty"`
+	Actor_Ids        []int     `json:"actor_ids"`
+	Summary          string    `json:"summary"`
+	Read             bool      `json:"read"`
+	Notification_Ids []int     `json:"notification_ids"`
+	Created_At       time.Time `json:"created_at"`
+}
+
+type UnreadCounts struct {
+	Unread  int            `json:"unread"`
+	By_Type map[string]int `json:"by_type"`
+}
+
+func notificationCursor(notification database.Notification) cursor {
+	return cursor{Id: notification.Id, Created_At: notification.Created_At}
+}
+
+func notificationGroupCursor(group NotificationGroup) cursor {
+	return cursor{Id: group.Id, Created_At: group.Created_At}
+}
+
+// notify stores notification and publishes it to its recipient. It does
+// nothing when the recipient would not want it.
+func (cfg *apiConfig) notify(notification database.Notification) error {
+	notification, created, err := cfg.DB.CreateNotification(notification)
+
+	if err != nil || !created {
+		return err
+	}
+
+	cfg.Hub.Publish(hubMessage{
+		Topic: fmt.Sprintf("notifications:%d", notification.User_Id),
+		Type:  "notification",
+		Data:  notification,
+	})
+
+	return nil
+}
+
+// notifyChirpAuthor notifies the author of the chirp with chirpId that
+// actorId acted on it. aboutId is the chirp the notification links to, such
+// as the reply.
+func (cfg *apiConfig) notifyChirpAuthor(notificationType string, chirpId, actorId, aboutId int) error {
+	chirp, err := cfg.DB.GetChirp(chirpId)
+
+	if err != nil {
+		return err
+	}
+
+	return cfg.notify(database.Notification{
+		User_Id:  chirp.Author_Id,
+		Type:     notificationType,
+		Actor_Id: actorId,
+		Chirp_Id: aboutId,
+	})
+}
+
+// notifyReferences tells the authors of the chirps that chirp replies to or
+// quotes about it.
+func (cfg *apiConfig) notifyReferences(chirp database.Chirp) error {
+	if chirp.In_Reply_To != 0 {
+		err := cfg.notifyChirpAuthor("reply", chirp.In_Reply_To, chirp.Author_Id, chirp.Id)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if chirp.Quote_Of != 0 {
+		return cfg.notifyChirpAuthor("quote", chirp.Quote_Of, chirp.Author_Id, chirp.Id)
+	}
+
+	return nil
+}
+
+// visibleNotifications returns the caller's notifications, newest first,
+// leaving out those from users they have since blocked or muted.
+func (cfg *apiConfig) visibleNotifications(caller viewer) ([]database.Notification, error) {
+	dbNotifications, err := cfg.DB.GetNotifications(caller.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := []database.Notification{}
+
+	for _, notification := range dbNotifications {
+		if notification.Actor_Id == 0 || caller.wantsInTimeline(notification.Actor_Id) {
+			notifications = append(notifications, notification)
+		}
+	}
+
+	sort.Slice(notifications, func(i, j int) bool {
+		return notifications[i].Id > notifications[j].Id
+	})
+
+	return notifications, nil
+}
+
+// handlerGetNotifications lists the caller's notifications newest first,
+// optionally only unread ones or one type. With group=true, notifications
+// that group are combined.
+func (cfg *apiConfig) handlerGetNotifications(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePageRequest(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil || caller.Id == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	notifications, err := cfg.visibleNotifications(caller)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve notifications")
+		return
+	}
+
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+	notificationType := r.URL.Query().Get("type")
+	filtered := []database.Notification{}
+
+	for _, notification := range notifications {
+		if (!unreadOnly || !notification.Read) && (notificationType == "" || notification.Type == notificationType) {
+			filtered = append(filtered, notification)
+		}
+	}
+
+	if r.URL.Query().Get("group") != "true" {
+		filtered, next, prev := paginate(filtered, page, notificationCursor, newestFirst)
+		setPageLinks(w, r, page, next, prev)
+
+		respondWithJSON(w, http.StatusOK, filtered)
+		return
+	}
+
+	dbUsers, err := cfg.DB.GetUsers()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retreive users")
+		return
+	}
+
+	groups, next, prev := paginate(groupNotifications(filtered, dbUsers), page, notificationGroupCursor, newestFirst)
+	setPageLinks(w, r, page, next, prev)
+
+	respondWithJSON(w, http.StatusOK, groups)
+}
+
+// groupNotifications combines notifications, which must be newest first,
+// into groups ordered by their newest notification.
+func groupNotifications(notifications []database.Notification, dbUsers []database.User) []NotificationGroup {
+	handles := map[int]string{}
+
+	for _, user := range dbUsers {
+		handles[user.Id] = user.Handle
+	}
+
+	groups := []NotificationGroup{}
+	groupIndex := map[string]int{}
+
+	for _, notification := range notifications {
+		key := strconv.Itoa(notification.Id)
+
+		if groupedNotificationTypes[notification.Type] {
+			key = fmt.Sprintf("%s:%d", notification.Type, notification.Chirp_Id)
+		}
+
+		i, ok := groupIndex[key]
+
+		if !ok {
+			i = len(groups)
+			groupIndex[key] = i
+			groups = append(groups, NotificationGroup{
+				Id:               notification.Id,
+				Type:             notification.Type,
+				Chirp_Id:         notification.Chirp_Id,
+				Report_Id:        notification.Report_Id,
+				Actor_Ids:        []int{},
+				Read:             true,
+				Notification_Ids: []int{},
+				Created_At:       notification.Created_At,
+			})
+		}
+
+		group := &groups[i]
+		group.Notification_Ids = append(group.Notification_Ids, notification.Id)
+		group.Read = group.Read && notification.Read
+
+		if notification.Actor_Id != 0 && !slices.Contains(group.Actor_Ids, notification.Actor_Id) {
+			group.Actor_Ids = append(group.Actor_Ids, notification.Actor_Id)
+		}
+	}
+
+	for i := range groups {
+		groups[i].Summary = notificationSummary(groups[i], handles)
+	}
+
+	return groups
+}
+
+func notificationSummary(group NotificationGroup, handles map[int]string) string {
+	verb, ok := notificationVerbs[group.Type]
+
+	if !ok {
+		if group.Type == "report_resolved" {
+			return "Your report was resolved"
+		}
+
+		return "You have a new notification"
+	}
+
+	if len(group.Actor_Ids) > 1 {
+		return fmt.Sprintf("%d people %s", len(group.Actor_Ids), verb)
+	}
+
+	actor := "Someone"
+
+	if len(group.Actor_Ids) == 1 && handles[group.Actor_Ids[0]] != "" {
+		actor = "@" + handles[group.Actor_Ids[0]]
+	}
+
+	return actor + " " + verb
+}
+
+func (cfg *apiConfig) handlerGetUnreadCount(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil || caller.Id == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	counts, err := cfg.unreadCounts(caller)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve notifications")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, counts)
+}
+
+func (cfg *apiConfig) unreadCounts(caller viewer) (UnreadCounts, error) {
+	notifications, err := cfg.visibleNotifications(caller)
+
+	if err != nil {
+		return UnreadCounts{}, err
+	}
+
+	counts := UnreadCounts{By_Type: map[string]int{}}
+
+	for _, notification := range notifications {
+		if !notification.Read {
+			counts.Unread++
+			counts.By_Type[notification.Type]++
+		}
+	}
+
+	return counts, nil
+}
+
+func (cfg *apiConfig) handlerMarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return
+	}
+
+	notification, err := cfg.DB.MarkNotificationRead(userId, id)
+
+	if errors.Is(err, database.ErrNotificationNotFound) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not update notification")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, notification)
+}
+
+// handlerMarkNotificationsRead marks the notifications with the given ids
+// read, such as those of a group, or all of the caller's notifications when
+// no ids are given. It responds with the remaining unread counts.
+func (cfg *apiConfig) handlerMarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Ids []int `json:"ids"`
+	}
+
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil || caller.Id == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	params := parameters{}
+
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&params)
+
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+			return
+		}
+	}
+
+	_, err = cfg.DB.MarkNotificationsRead(caller.Id, params.Ids)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not update notifications")
+		return
+	}
+
+	counts, err := cfg.unreadCounts(caller)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve notifications")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, counts)
+}
+
+func (cfg *apiConfig) handlerGetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(userId)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, notificationPreferences(user))
+}
+
+// handlerSetNotificationPreferences turns the given notification types on
+// or off, leaving the others as they were.
+func (cfg *apiConfig) handlerSetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	preferences := map[string]bool{}
+	err = decoder.Decode(&preferences)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	for notificationType := range preferences {
+		if !slices.Contains(notificationTypes, notificationType) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("notification types must be from %s", strings.Join(notificationTypes, ", ")))
+			return
+		}
+	}
+
+	user, err := cfg.DB.SetNotificationPreferences(userId, preferences)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not update preferences")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, notificationPreferences(user))
+}
+
+func notificationPreferences(user database.User) map[string]bool {
+	preferences := map[string]bool{}
+
+	for _, notificationType := range notificationTypes {
+		preferences[notificationType] = user.WantsNotification(notificationType)
+	}
+
+	return preferences
+}
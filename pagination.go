@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultPageSize = 20
+const maxPageSize = 100
+
+type cursor struct {
+	Id         int       `json:"id"`
+	Created_At time.Time `json:"created_at"`
+}
+
+func cursorPrecedes(a, b cursor) bool {
+	if !a.Created_At.Equal(b.Created_At) {
+		return a.Created_At.Before(b.Created_At)
+	}
+
+	return a.Id < b.Id
+}
+
+type pageRequest struct {
+	limit  int
+	after  *cursor
+	before *cursor
+}
+
+func encodeCursor(c cursor) string {
+	dat, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	c := cursor{}
+
+	dat, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+
+	err = json.Unmarshal(dat, &c)
+
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+
+	return c, nil
+}
+
+// parsePageRequest reads limit, after and before from the query string.
+// Listings are always paginated, defaulting to defaultPageSize items.
+func parsePageRequest(r *http.Request) (pageRequest, error) {
+	query := r.URL.Query()
+	page := pageRequest{limit: defaultPageSize}
+
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+
+		if err != nil || limit < 1 {
+			return page, errors.New("limit must be a positive integer")
+		}
+
+		page.limit = min(limit, maxPageSize)
+	}
+
+	if query.Has("after") && query.Has("before") {
+		return page, errors.New("after and before cannot be combined")
+	}
+
+	if query.Has("after") {
+		c, err := decodeCursor(query.Get("after"))
+
+		if err != nil {
+			return page, err
+		}
+
+		page.after = &c
+	}
+
+	if query.Has("before") {
+		c, err := decodeCursor(query.Get("before"))
+
+		if err != nil {
+			return page, err
+		}
+
+		page.before = &c
+	}
+
+	return page, nil
+}
+
+// paginate slices items, which must already be in display order. precedes
+// reports whether cursor a comes before cursor b in that same order, so a
+// cursor still works when the item it was taken from has since been deleted.
+func paginate[T any](items []T, page pageRequest, key func(T) cursor, precedes func(a, b cursor) bool) (result []T, next, prev *cursor) {
+	start := 0
+	end := len(items)
+
+	if page.after != nil {
+		for start < end && !precedes(*page.after, key(items[start])) {
+			start++
+		}
+	}
+
+	if page.before != nil {
+		end = start
+
+		for end < len(items) && precedes(key(items[end]), *page.before) {
+			end++
+		}
+	}
+
+	if end-start > page.limit {
+		if page.before != nil {
+			start = end - page.limit
+		} else {
+			end = start + page.limit
+		}
+	}
+
+	result = items[start:end]
+
+	if len(result) == 0 {
+		return result, nil, nil
+	}
+
+	if end < len(items) {
+		c := key(result[len(result)-1])
+		next = &c
+	}
+
+	if start > 0 {
+		c := key(result[0])
+		prev = &c
+	}
+
+	return result, next, prev
+}
+
+func setPageLinks(w http.ResponseWriter, r *http.Request, page pageRequest, next, prev *cursor) {
+	links := []string{}
+
+	for _, link := range []struct {
+		rel string
+		c   *cursor
+	}{{"next", next}, {"prev", prev}} {
+		rel, c := link.rel, link.c
+
+		if c == nil {
+			continue
+		}
+
+		query := r.URL.Query()
+		query.Del("after")
+		query.Del("before")
+		query.Set("limit", strconv.Itoa(page.limit))
+
+		if rel == "next" {
+			query.Set("after", encodeCursor(*c))
+		} else {
+			query.Set("before", encodeCursor(*c))
+		}
+
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, query.Encode(), rel))
+	}
+
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const (
+	polkaTimestampHeader = "X-Polka-Timestamp"
+	polkaSignatureHeader = "X-Polka-Signature"
+	maxPolkaBodySize     = 1 << 20
+)
+
+// polkaVerifier authenticates Polka webhooks. Signed requests carry a unix
+// timestamp and one or more "v1=<hex>" HMAC-SHA256 signatures of
+// "<timestamp>.<body>". Any configured secret may match, so secrets can be
+// rotated by adding the new one before Polka switches to it. Requests outside
+// the tolerance window are rejected. A replay within it is a repeat of an
+// event id, which the webhook inbox only applies once.
+//
+// The older "Authorization: ApiKey <key>" scheme is deprecated. It is only
+// accepted when explicitly allowed and no secrets are configured.
+type polkaVerifier struct {
+	secrets   [][]byte
+	apiKey    string
+	tolerance time.Duration
+}
+
+func newPolkaVerifier(secrets []string, apiKey string, allowApiKey bool, tolerance time.Duration) *polkaVerifier {
+	verifier := &polkaVerifier{
+		tolerance: tolerance,
+	}
+
+	for _, secret := range secrets {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			verifier.secrets = append(verifier.secrets, []byte(secret))
+		}
+	}
+
+	switch {
+	case !allowApiKey:
+	case len(verifier.secrets) > 0:
+		log.Printf("Ignoring POLKA_ALLOW_API_KEY as webhook secrets are configured")
+	case apiKey == "":
+		log.Printf("Ignoring POLKA_ALLOW_API_KEY as POLKA_KEY is not set")
+	default:
+		log.Printf("DEPRECATED: accepting Polka webhooks with an ApiKey; set POLKA_WEBHOOK_SECRETS to use signatures")
+		verifier.apiKey = apiKey
+	}
+
+	return verifier
+}
+
+// Verify checks the request's credentials against body, which must be the
+// raw request body.
+func (verifier *polkaVerifier) Verify(header http.Header, body []byte, now time.Time) error {
+	if header.Get(polkaSignatureHeader) != "" || header.Get(polkaTimestampHeader) != "" {
+		return verifier.verifySignature(header, body, now)
+	}
+
+	scheme, key, found := strings.Cut(header.Get("Authorization"), " ")
+
+	if !found || scheme != "ApiKey" || key == "" {
+		return errors.New("missing webhook signature")
+	}
+
+	if verifier.apiKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(verifier.apiKey)) != 1 {
+		return errors.New("invalid API key")
+	}
+
+	return nil
+}
+
+func (verifier *polkaVerifier) verifySignature(header http.Header, body []byte, now time.Time) error {
+	timestampString := header.Get(polkaTimestampHeader)
+	timestamp, err := strconv.ParseInt(timestampString, 10, 64)
+
+	if err != nil {
+		return errors.New("malformed webhook timestamp")
+	}
+
+	signedAt := time.Unix(timestamp, 0)
+
+	if now.Sub(signedAt).Abs() > verifier.tolerance {
+		return errors.New("webhook timestamp outside tolerance")
+	}
+
+	signatures := []string{}
+
+	for _, part := range strings.Split(header.Get(polkaSignatureHeader), ",") {
+		version, signature, found := strings.Cut(strings.TrimSpace(part), "=")
+
+		if !found || signature == "" {
+			return errors.New("malformed webhook signature")
+		}
+
+		if version == "v1" {
+			signatures = append(signatures, signature)
+		}
+	}
+
+	if len(signatures) == 0 {
+		return errors.New("no supported webhook signature")
+	}
+
+	for _, secret := range verifier.secrets {
+		expected := signWebhook(secret, timestampString, body)
+
+		for _, signature := range signatures {
+			if subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) == 1 {
+				return nil
+			}
+		}
+	}
+
+	return errors.New("invalid webhook signature")
+}
+
+type polkaEvent struct {
+	Id         string     `json:"id"`
+	Event      string     `json:"event"`
+	Created_At *time.Time `json:"created_at"`
+	Data       struct {
+		User_id            int        `json:"user_id"`
+		Plan               string     `json:"plan"`
+		Current_Period_End *time.Time `json:"current_period_end"`
+	} `json:"data"`
+}
+
+// handlerPolkaPost stores each verified event in the webhook inbox before
+// applying it, so a delivery Polka retries is only applied once and a failed
+// one can be retried or replayed later.
+func (cfg *apiConfig) handlerPolkaPost(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPolkaBodySize))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't read input")
+		return
+	}
+
+	err = cfg.Polka.Verify(r.Header, body, time.Now())
+
+	if err != nil {
+		cfg.audit(r, 0, "polka.webhook", "", auditDenied)
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	input := polkaEvent{}
+	err = json.Unmarshal(body, &input)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	event, received, err := cfg.DB.ReceiveWebhookEvent(database.WebhookEvent{
+		Id:       polkaEventId(input, body),
+		Provider: "polka",
+		Type:     input.Event,
+		Payload:  body,
+	})
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not store webhook event")
+		return
+	}
+
+	if !received && event.Status != "failed" {
+		respondWithJSON(w, http.StatusNoContent, "")
+		return
+	}
+
+	_, err = cfg.processWebhookEvent(r, event.Id, "pending", "failed")
+
+	if errors.Is(err, database.ErrWebhookEventBusy) {
+		respondWithJSON(w, http.StatusNoContent, "")
+		return
+	}
+
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// polkaEventId returns Polka's event id, falling back to a hash of the body
+// for deliveries without one so identical retries are still recognised.
+func polkaEventId(event polkaEvent, body []byte) string {
+	if event.Id != "" {
+		return event.Id
+	}
+
+	sum := sha256.Sum256(body)
+
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// polkaPeriodEnd is the end of the period paid for by an upgrade or renewal:
+// the one Polka sent, or else one billingPeriod from when the event happened.
+// It never depends on the current subscription, so applying an event twice
+// gives the same result.
+func polkaPeriodEnd(input polkaEvent, event database.WebhookEvent) *time.Time {
+	if input.Data.Current_Period_End != nil {
+		return input.Data.Current_Period_End
+	}
+
+	start := event.Received_At
+
+	if input.Created_At != nil {
+		start = *input.Created_At
+	}
+
+	end := start.UTC().Add(billingPeriod)
+
+	return &end
+}
+
+// applyPolkaEvent applies a stored Polka event. r is nil when the event is
+// retried or replayed rather than delivered.
+func (cfg *apiConfig) applyPolkaEvent(r *http.Request, event database.WebhookEvent) error {
+	input := polkaEvent{}
+	err := json.Unmarshal(event.Payload, &input)
+
+	if err != nil {
+		return err
+	}
+
+	if !subscriptionEvents[input.Event] {
+		return errIgnoredWebhookEvent
+	}
+
+	_, err = cfg.DB.UpdateSubscription(input.Data.User_id, func(sub *database.Subscription) error {
+		if input.Created_At != nil && sub.Last_Event_At != nil && input.Created_At.Before(*sub.Last_Event_At) {
+			return fmt.Errorf("%w: older than the last applied event", errIgnoredWebhookEvent)
+		}
+
+		err := applySubscriptionEvent(sub, input.Event, input.Data.Plan, polkaPeriodEnd(input, event), time.Now().UTC())
+
+		if err == nil && input.Created_At != nil {
+			sub.Last_Event_At = input.Created_At
+		}
+
+		return err
+	})
+
+	if errors.Is(err, errIgnoredWebhookEvent) {
+		return err
+	}
+
+	cfg.audit(r, 0, "subscription."+strings.TrimPrefix(input.Event, "user."), auditTarget("user", input.Data.User_id), auditOutcome(err))
+
+	return err
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+type viewer struct {
+	Id      int
+	blocked map[int]bool
+	muted   map[int]bool
+}
+
+func (cfg *apiConfig) loadViewer(r *http.Request) (viewer, error) {
+	v := viewer{
+		blocked: map[int]bool{},
+		muted:   map[int]bool{},
+	}
+
+	if r.Header.Get("Authorization") == "" {
+		return v, nil
+	}
+
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		return v, err
+	}
+
+	relationships, err := cfg.DB.GetRelationships(userId)
+
+	if err != nil {
+		return v, err
+	}
+
+	v.Id = userId
+
+	for _, id := range relationships.Blocking {
+		v.blocked[id] = true
+	}
+
+	for _, id := range relationships.BlockedBy {
+		v.blocked[id] = true
+	}
+
+	for _, id := range relationships.Muting {
+		v.muted[id] = true
+	}
+
+	return v, nil
+}
+
+func (v viewer) canSee(authorId int) bool {
+	return !v.blocked[authorId]
+}
+
+func (v viewer) wantsInTimeline(authorId int) bool {
+	return v.canSee(authorId) && !v.muted[authorId]
+}
+
+func (cfg *apiConfig) handlerBlockUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateRelationship(w, r, cfg.DB.BlockUser)
+}
+
+func (cfg *apiConfig) handlerUnblockUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateRelationship(w, r, cfg.DB.UnblockUser)
+}
+
+func (cfg *apiConfig) handlerMuteUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateRelationship(w, r, cfg.DB.MuteUser)
+}
+
+func (cfg *apiConfig) handlerUnmuteUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateRelationship(w, r, cfg.DB.UnmuteUser)
+}
+
+func (cfg *apiConfig) handlerFollowUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateRelationship(w, r, func(userId, targetId int) error {
+		following, err := cfg.DB.GetFollowing(userId)
+
+		if err != nil {
+			return err
+		}
+
+		err = cfg.DB.FollowUser(userId, targetId)
+
+		if err != nil || slices.Contains(following, targetId) {
+			return err
+		}
+
+		cfg.emitEvent("user.followed", []int{targetId}, userFollowedData{Follower_Id: userId, Followed_Id: targetId})
+
+		err = cfg.notify(database.Notification{
+			User_Id:  targetId,
+			Type:     "follow",
+			Actor_Id: userId,
+		})
+
+		if err != nil {
+			log.Printf("Could not notify user %d of follow: %s", targetId, err)
+		}
+
+		return nil
+	})
+}
+
+func (cfg *apiConfig) handlerUnfollowUser(w http.ResponseWriter, r *http.Request) {
+	cfg.updateRelationship(w, r, cfg.DB.UnfollowUser)
+}
+
+func (cfg *apiConfig) updateRelationship(w http.ResponseWriter, r *http.Request, update func(userId, targetId int) error) {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	targetId, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return
+	}
+
+	if targetId == userId {
+		respondWithError(w, http.StatusBadRequest, "Cannot target yourself")
+		return
+	}
+
+	err = update(userId, targetId)
+
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if errors.Is(err, database.ErrBlocked) {
+		respondWithError(w, http.StatusForbidden, "Cannot follow this user")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not update relationship")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+func (cfg *apiConfig) handlerGetBlocks(w http.ResponseWriter, r *http.Request) {
+	cfg.listRelationship(w, r, func(relationships database.Relationships) []int {
+		return relationships.Blocking
+	})
+}
+
+func (cfg *apiConfig) handlerGetMutes(w http.ResponseWriter, r *http.Request) {
+	cfg.listRelationship(w, r, func(relationships database.Relationships) []int {
+		return relationships.Muting
+	})
+}
+
+func (cfg *apiConfig) listRelationship(w http.ResponseWriter, r *http.Request, pick func(database.Relationships) []int) {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	relationships, err := cfg.DB.GetRelationships(userId)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve relationships")
+		return
+	}
+
+	dbUsers, err := cfg.DB.GetUsers()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retreive users")
+		return
+	}
+
+	ids := map[int]bool{}
+
+	for _, id := range pick(relationships) {
+		ids[id] = true
+	}
+
+	users := []PublicUser{}
+
+	for _, dbUser := range dbUsers {
+		if ids[dbUser.Id] {
+			users = append(users, publicUserFromDB(dbUser))
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+
+	respondWithJSON(w, http.StatusOK, users)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+var errReportOutranked = errors.New("Cannot suspend a user with an equal or higher role")
+
+var reportCategories = []string{"spam", "harassment", "hate", "violence", "misinformation", "other"}
+
+// reportResolutions maps the actions a moderator can take on a report to the
+// resolution recorded on it.
+var reportResolutions = map[string]string{
+	"remove_chirp": "removed",
+	"suspend_user": "suspended",
+	"dismiss":      "dismissed",
+}
+
+func (cfg *apiConfig) handlerCreateReport(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Target_Type string `json:"target_type"`
+		Target_Id   int    `json:"target_id"`
+		Category    string `json:"category"`
+		Details     string `json:"details"`
+	}
+
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	if params.Target_Type != "chirp" && params.Target_Type != "user" {
+		respondWithError(w, http.StatusBadRequest, "target_type must be chirp or user")
+		return
+	}
+
+	if !validReportCategory(params.Category) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("category must be one of %s", strings.Join(reportCategories, ", ")))
+		return
+	}
+
+	if params.Target_Type == "user" && params.Target_Id == userId {
+		respondWithError(w, http.StatusBadRequest, "Cannot target yourself")
+		return
+	}
+
+	report, err := cfg.DB.CreateReport(database.Report{
+		Reporter_Id: userId,
+		Target_Type: params.Target_Type,
+		Target_Id:   params.Target_Id,
+		Category:    params.Category,
+		Details:     strings.TrimSpace(params.Details),
+	})
+
+	if errors.Is(err, database.ErrChirpNotFound) || errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
+
+	if errors.Is(err, database.ErrAlreadyReported) {
+		respondWithError(w, http.StatusConflict, "You have already reported this")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not create report")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, report)
+}
+
+func validReportCategory(category string) bool {
+	for _, valid := range reportCategories {
+		if category == valid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reportFlaggedChirp queues a chirp the content filter flagged for review.
+// Failures are logged rather than surfaced, as the chirp is already posted.
+func (cfg *apiConfig) reportFlaggedChirp(chirp database.Chirp, words []string) {
+	_, err := cfg.DB.CreateReport(database.Report{
+		Target_Type: "chirp",
+		Target_Id:   chirp.Id,
+		Category:    "filter",
+		Details:     "Matched filter words: " + strings.Join(words, ", "),
+	})
+
+	if err != nil {
+		log.Printf("Could not report chirp %d: %s", chirp.Id, err)
+	}
+}
+
+// handlerGetReports lists the queue oldest first, so the longest waiting
+// reports are handled first. It can be narrowed by status, category and
+// assignee_id.
+func (cfg *apiConfig) handlerGetReports(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	category := r.URL.Query().Get("category")
+	assigneeId := -1
+
+	if assigneeString := r.URL.Query().Get("assignee_id"); assigneeString != "" {
+		parsed, err := strconv.Atoi(assigneeString)
+
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Could not parse assignee_id")
+			return
+		}
+
+		assigneeId = parsed
+	}
+
+	dbReports, err := cfg.DB.GetReports()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve reports")
+		return
+	}
+
+	reports := []database.Report{}
+
+	for _, report := range dbReports {
+		if status != "" && report.Status != status {
+			continue
+		}
+
+		if category != "" && report.Category != category {
+			continue
+		}
+
+		if assigneeId != -1 && report.Assignee_Id != assigneeId {
+			continue
+		}
+
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Id < reports[j].Id
+	})
+
+	respondWithJSON(w, http.StatusOK, reports)
+}
+
+func (cfg *apiConfig) handlerGetReport(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return
+	}
+
+	report, err := cfg.DB.GetReport(id)
+
+	if errors.Is(err, database.ErrReportNotFound) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve report")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+func (cfg *apiConfig) handlerAssignReport(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Assignee_Id *int `json:"assignee_id"`
+	}
+
+	actorId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	assigneeId := actorId
+
+	if params.Assignee_Id != nil {
+		assigneeId = *params.Assignee_Id
+	}
+
+	if assigneeId != 0 {
+		assignee, err := cfg.DB.GetUser(assigneeId)
+
+		if err == nil && !hasRole(assignee, roleModerator) {
+			respondWithError(w, http.StatusBadRequest, "Assignee must be a moderator")
+			return
+		}
+	}
+
+	report, err := cfg.DB.AssignReport(id, actorId, assigneeId)
+
+	if !cfg.respondReportError(w, err) {
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+func (cfg *apiConfig) handlerResolveReport(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}
+
+	actorId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode input")
+		return
+	}
+
+	resolution, ok := reportResolutions[params.Action]
+
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "action must be one of remove_chirp, suspend_user, dismiss")
+		return
+	}
+
+	note := strings.TrimSpace(params.Note)
+
+	report, removed, err := cfg.DB.ResolveReport(id, actorId, resolution, note, canSuspend)
+
+	if errors.Is(err, database.ErrReportNotFound) || errors.Is(err, database.ErrReportResolved) {
+		cfg.respondReportError(w, err)
+		return
+	}
+
+	if errors.Is(err, database.ErrChirpNotFound) || errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, http.StatusConflict, "The reported content no longer exists")
+		return
+	}
+
+	if errors.Is(err, errReportOutranked) {
+		cfg.audit(r, actorId, "report."+params.Action, auditTarget("report", id), auditDenied)
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	if errors.Is(err, database.ErrReportNotChirp) {
+		respondWithError(w, http.StatusBadRequest, "Only reported chirps can be removed")
+		return
+	}
+
+	cfg.audit(r, actorId, "report."+params.Action, auditTarget("report", id), auditOutcome(err))
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not update report")
+		return
+	}
+
+	if removed.Id != 0 {
+		cfg.Trends.Remove(removed.Id)
+		cfg.emitChirpDeleted(removed)
+		cfg.federateChirp("chirp.deleted", removed)
+	}
+
+	if report.Reporter_Id != 0 {
+		err = cfg.notify(database.Notification{
+			User_Id:   report.Reporter_Id,
+			Type:      "report_resolved",
+			Actor_Id:  actorId,
+			Report_Id: report.Id,
+		})
+
+		if err != nil {
+			log.Printf("Could not notify reporter of report %d: %s", report.Id, err)
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// canSuspend stops moderators suspending users of their own rank or above.
+func canSuspend(actor, target database.User) error {
+	if roleRanks[userRole(target)] >= roleRanks[userRole(actor)] {
+		return errReportOutranked
+	}
+
+	return nil
+}
+
+// respondReportError writes the response for err from a report lookup or
+// update, and reports whether the caller may continue.
+func (cfg *apiConfig) respondReportError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, database.ErrReportNotFound):
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+	case errors.Is(err, database.ErrReportResolved):
+		respondWithError(w, http.StatusConflict, "Report is already resolved")
+	case errors.Is(err, database.ErrUserNotFound):
+		respondWithError(w, http.StatusBadRequest, "Assignee does not exist")
+	default:
+		respondWithError(w, http.StatusInternalServerError, "Could not update report")
+	}
+
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// roleRanks orders the roles; each role has every permission of the roles
+// ranked below it.
+var roleRanks = map[string]int{
+	roleUser:      0,
+	roleModerator: 1,
+	roleAdmin:     2,
+}
+
+// userRole returns the user's role, treating users created before roles
+// existed as regular users.
+func userRole(user database.User) string {
+	if user.Role == "" {
+		return roleUser
+	}
+
+	return user.Role
+}
+
+func hasRole(user database.User, role string) bool {
+	return roleRanks[userRole(user)] >= roleRanks[role]
+}
+
+func suspensionMessage(user database.User) string {
+	if user.Suspension == "" {
+		return "Your account is suspended"
+	}
+
+	return "Your account is suspended: " + user.Suspension
+}
+
+// requireRole wraps next so it is only served to active users with at least
+// the given role.
+func (cfg *apiConfig) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := cfg.authenticate(r)
+
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		user, err := cfg.DB.GetUser(userId)
+
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+
+		if user.Is_Suspended {
+			cfg.audit(r, userId, "admin.access", r.URL.Path, auditDenied)
+			respondWithError(w, http.StatusForbidden, suspensionMessage(user))
+			return
+		}
+
+		if !hasRole(user, role) {
+			cfg.audit(r, userId, "admin.access", r.URL.Path, auditDenied)
+			respondWithError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requireActive responds with an error and returns false when the user does
+// not exist or is suspended.
+func (cfg *apiConfig) requireActive(w http.ResponseWriter, userId int) bool {
+	user, err := cfg.DB.GetUser(userId)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return false
+	}
+
+	if user.Is_Suspended {
+		respondWithError(w, http.StatusForbidden, suspensionMessage(user))
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+const maxOutboundRedirects = 3
+
+var errPrivateAddress = errors.New("address is not publicly routable")
+
+// blockedPrefixes are ranges outside the usual private, loopback and link
+// local ones that still must not be reached from outbound requests.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// isPublicAddr reports whether addr is a unicast address on the public
+// internet, so not loopback, private, link local (which includes cloud
+// metadata services) or otherwise reserved.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// publicOnlyControl runs once the dialer has resolved the host, so it checks
+// the address actually connected to and cannot be bypassed by DNS that
+// answers differently at validation and at delivery time.
+func publicOnlyControl(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+
+	if err != nil {
+		return err
+	}
+
+	if !isPublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%s: %w", addrPort.Addr(), errPrivateAddress)
+	}
+
+	return nil
+}
+
+// newPublicClient returns a client for requests to user supplied URLs. It
+// only connects to public addresses, ignores proxy settings so the check
+// applies to the real destination, and follows a few redirects to http and
+// https URLs only.
+func newPublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: publicOnlyControl,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxOutboundRedirects {
+				return errors.New("too many redirects")
+			}
+
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("redirect to a non-http URL")
+			}
+
+			return nil
+		},
+	}
+}
+
+// checkPublicHost resolves the URL's host and fails if any of its addresses
+// is not public. It gives early feedback when a URL is registered; the
+// dialer still checks every connection.
+func checkPublicHost(ctx context.Context, parsed *url.URL) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", parsed.Hostname())
+
+	if err != nil {
+		return fmt.Errorf("could not resolve %s", parsed.Hostname())
+	}
+
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			return fmt.Errorf("%s resolves to %s: %w", parsed.Hostname(), addr.Unmap(), errPrivateAddress)
+		}
+	}
+
+	return nil
+}
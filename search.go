@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+type searchRequest struct {
+	query      database.SearchQuery
+	fromHandle string
+}
+
+// parseSearchQuery understands plain words, "quoted phrases", #hashtags,
+// from:handle, and since:/until: dates in YYYY-MM-DD form. until is
+// inclusive of the whole day.
+func parseSearchQuery(q string) (searchRequest, error) {
+	request := searchRequest{}
+
+	for len(q) > 0 {
+		q = strings.TrimLeft(q, " \t\n")
+
+		if q == "" {
+			break
+		}
+
+		if q[0] == '"' {
+			phrase, rest, found := strings.Cut(q[1:], `"`)
+
+			if !found {
+				return request, errors.New("unterminated phrase")
+			}
+
+			if terms := database.Tokenize(phrase); len(terms) > 0 {
+				request.query.Phrases = append(request.query.Phrases, terms)
+			}
+
+			q = rest
+			continue
+		}
+
+		word, rest, _ := strings.Cut(q, " ")
+		q = rest
+
+		field, value, hasField := strings.Cut(word, ":")
+
+		switch {
+		case hasField && field == "from":
+			request.fromHandle = strings.TrimPrefix(value, "@")
+		case hasField && (field == "since" || field == "until"):
+			date, err := time.Parse("2006-01-02", value)
+
+			if err != nil {
+				return request, fmt.Errorf("invalid %s date, expected YYYY-MM-DD", field)
+			}
+
+			if field == "since" {
+				request.query.Since = date
+			} else {
+				request.query.Until = date.AddDate(0, 0, 1)
+			}
+		case strings.HasPrefix(word, "#") && len(word) > 1:
+			request.query.Hashtags = append(request.query.Hashtags, strings.ToLower(word[1:]))
+		default:
+			request.query.Terms = append(request.query.Terms, database.Tokenize(word)...)
+		}
+	}
+
+	return request, nil
+}
+
+func (cfg *apiConfig) handlerSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	if q == "" {
+		respondWithError(w, http.StatusBadRequest, "Search query is required")
+		return
+	}
+
+	page, err := parsePageRequest(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if r.URL.Query().Get("type") == "users" {
+		cfg.searchUsers(w, r, caller, q, page)
+		return
+	}
+
+	request, err := parseSearchQuery(q)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if request.fromHandle != "" {
+		author, err := cfg.DB.GetUserByHandle(request.fromHandle)
+
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithJSON(w, http.StatusOK, []Chirp{})
+			return
+		}
+
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't retreive users")
+			return
+		}
+
+		request.query.Author_Id = author.Id
+	}
+
+	results, err := cfg.DB.SearchChirps(request.query)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not search Chirps")
+		return
+	}
+
+	visible := []database.Chirp{}
+
+	for _, result := range results {
+		if caller.canSee(result.Chirp.Author_Id) {
+			visible = append(visible, result.Chirp)
+		}
+	}
+
+	chirps, err := cfg.renderChirps(caller, visible)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, paginateRanked(w, r, chirps, page))
+}
+
+func (cfg *apiConfig) searchUsers(w http.ResponseWriter, r *http.Request, caller viewer, q string, page pageRequest) {
+	dbUsers, err := cfg.DB.SearchUsers(q)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retreive users")
+		return
+	}
+
+	users := []PublicUser{}
+
+	for _, dbUser := range dbUsers {
+		if caller.canSee(dbUser.Id) {
+			users = append(users, publicUserFromDB(dbUser))
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, paginateRanked(w, r, users, page))
+}
+
+// paginateRanked pages through results whose order comes from ranking rather
+// than from a field, so cursors carry the result's position.
+func paginateRanked[T any](w http.ResponseWriter, r *http.Request, items []T, page pageRequest) []T {
+	type ranked struct {
+		item     T
+		position int
+	}
+
+	rankedItems := make([]ranked, 0, len(items))
+
+	for i, item := range items {
+		rankedItems = append(rankedItems, ranked{item, i + 1})
+	}
+
+	rankedItems, next, prev := paginate(rankedItems, page, func(item ranked) cursor {
+		return cursor{Id: item.position}
+	}, cursorPrecedes)
+	setPageLinks(w, r, page, next, prev)
+
+	result := make([]T, 0, len(rankedItems))
+
+	for _, item := range rankedItems {
+		result = append(result, item.item)
+	}
+
+	return result
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const streamPingInterval = 30 * time.Second
+
+type streamedChirpDeletion struct {
+	Id        int `json:"id"`
+	Author_Id int `json:"author_id"`
+}
+
+// handlerStream sends chirp.created, chirp.updated and chirp.deleted events
+// as Server-Sent Events, optionally only those by author_id or, with timeline=true, those
+// that belong in the caller's timeline. Clients reconnecting with
+// Last-Event-ID get the events they missed; if those are no longer buffered
+// a reset event tells them to refetch instead.
+func (cfg *apiConfig) handlerStream(w http.ResponseWriter, r *http.Request) {
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	wanted, ok := cfg.streamAuthors(w, r, caller)
+
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+
+	missed := []database.ChirpEvent{}
+	complete := true
+	var sub *database.ChirpSubscription
+
+	if lastEventId == "" {
+		sub = cfg.DB.ChirpEvents().Subscribe()
+	} else {
+		lastId, err := strconv.Atoi(lastEventId)
+
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Could not parse Last-Event-ID")
+			return
+		}
+
+		missed, complete, sub = cfg.DB.ChirpEvents().Resume(lastId)
+	}
+
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprint(w, "retry: 3000\n\n")
+
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+
+	for _, event := range missed {
+		writeStreamEvent(w, event, caller, wanted)
+	}
+
+	flusher.Flush()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case event, ok := <-sub.C:
+			// The subscription is closed when the client falls behind. It
+			// reconnects with the last id it received and catches up.
+			if !ok {
+				return
+			}
+
+			writeStreamEvent(w, event, caller, wanted)
+		}
+
+		flusher.Flush()
+	}
+}
+
+// streamAuthors returns the authors whose chirps the stream is limited to,
+// or nil when it is not limited, writing the error response itself when the
+// query is invalid.
+func (cfg *apiConfig) streamAuthors(w http.ResponseWriter, r *http.Request, caller viewer) (map[int]bool, bool) {
+	authorIdString := r.URL.Query().Get("author_id")
+	timeline := r.URL.Query().Get("timeline") == "true"
+
+	if authorIdString != "" && timeline {
+		respondWithError(w, http.StatusBadRequest, "author_id and timeline cannot be combined")
+		return nil, false
+	}
+
+	if authorIdString != "" {
+		authorId, err := strconv.Atoi(authorIdString)
+
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Could not parse author_id")
+			return nil, false
+		}
+
+		return map[int]bool{authorId: true}, true
+	}
+
+	if !timeline {
+		return nil, true
+	}
+
+	if caller.Id == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return nil, false
+	}
+
+	following, err := cfg.DB.GetFollowing(caller.Id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve relationships")
+		return nil, false
+	}
+
+	authors := map[int]bool{caller.Id: true}
+
+	for _, id := range following {
+		if caller.wantsInTimeline(id) {
+			authors[id] = true
+		}
+	}
+
+	return authors, true
+}
+
+// writeStreamEvent writes event if the caller can see it and it is by one of
+// the wanted authors.
+func writeStreamEvent(w http.ResponseWriter, event database.ChirpEvent, caller viewer, wanted map[int]bool) {
+	authorId := event.Chirp.Author_Id
+
+	if !caller.canSee(authorId) || (wanted != nil && !wanted[authorId]) {
+		return
+	}
+
+	dat, err := json.Marshal(chirpEventData(event))
+
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, dat)
+}
+
+// chirpEventData is what clients are sent for event. New and edited chirps
+// are sent without their quoted chirp, which clients can fetch by quote_of.
+func chirpEventData(event database.ChirpEvent) interface{} {
+	if event.Type == "chirp.deleted" {
+		return streamedChirpDeletion{Id: event.Chirp.Id, Author_Id: event.Chirp.Author_Id}
+	}
+
+	chirp := chirpFromDB(event.Chirp, database.ChirpCounts{})
+
+	if chirp.Entities == nil {
+		chirp.Entities = []database.Entity{}
+	}
+
+	return chirp
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const (
+	defaultPlan   = "chirpy_red"
+	billingPeriod = 30 * 24 * time.Hour
+	// subscriptionGracePeriod is how long after the end of the paid period a
+	// subscription keeps its plan while waiting for a renewal or retried
+	// payment.
+	subscriptionGracePeriod = 3 * 24 * time.Hour
+)
+
+// subscriptionEvents are the Polka events that change a subscription.
+var subscriptionEvents = map[string]bool{
+	"user.upgraded":       true,
+	"user.renewed":        true,
+	"user.payment_failed": true,
+	"user.downgraded":     true,
+	"user.refunded":       true,
+}
+
+type SubscriptionResponse struct {
+	database.Subscription
+	Is_Chirpy_Red bool `json:"is_chirpy_red"`
+}
+
+// applySubscriptionEvent moves sub to the state a Polka event, or an admin
+// grant or revocation, describes and records the change in its history.
+// periodEnd is optional; without it a new or renewed subscription runs for
+// one billingPeriod.
+func applySubscriptionEvent(sub *database.Subscription, event, plan string, periodEnd *time.Time, now time.Time) error {
+	switch event {
+	case "user.upgraded", "user.renewed", "admin.granted":
+		if plan == "" {
+			plan = sub.Plan
+		}
+
+		if plan == "" {
+			plan = defaultPlan
+		}
+
+		if periodEnd == nil {
+			end := now.Add(billingPeriod)
+			periodEnd = &end
+		}
+
+		sub.Plan = plan
+		sub.Source = subscriptionEventSource(event)
+		sub.Status = "active"
+		sub.Current_Period_End = periodEnd
+	case "user.payment_failed":
+		if sub.Status == "active" {
+			sub.Status = "past_due"
+		}
+	case "user.downgraded", "admin.revoked":
+		sub.Status = "canceled"
+	case "user.refunded":
+		sub.Status = "refunded"
+	case "subscription.expired":
+		sub.Status = "expired"
+	default:
+		return errIgnoredWebhookEvent
+	}
+
+	sub.History = append(sub.History, database.SubscriptionChange{
+		Event:              event,
+		Plan:               sub.Plan,
+		Source:             subscriptionEventSource(event),
+		Status:             sub.Status,
+		Current_Period_End: sub.Current_Period_End,
+		Created_At:         now,
+	})
+
+	return nil
+}
+
+// subscriptionEventSource names who caused a subscription event.
+func subscriptionEventSource(event string) string {
+	switch {
+	case strings.HasPrefix(event, "admin."):
+		return "admin"
+	case strings.HasPrefix(event, "subscription."):
+		return "chirpy"
+	default:
+		return "polka"
+	}
+}
+
+// grantChirpyRed gives the user plan until periodEnd on behalf of an
+// administrator, recorded in the subscription history like a payment.
+func grantChirpyRed(db *database.DB, userId int, plan string, periodEnd *time.Time) error {
+	_, err := db.UpdateSubscription(userId, func(sub *database.Subscription) error {
+		return applySubscriptionEvent(sub, "admin.granted", plan, periodEnd, time.Now().UTC())
+	})
+
+	return err
+}
+
+func revokeChirpyRed(db *database.DB, userId int) error {
+	_, err := db.UpdateSubscription(userId, func(sub *database.Subscription) error {
+		return applySubscriptionEvent(sub, "admin.revoked", "", nil, time.Now().UTC())
+	})
+
+	return err
+}
+
+func subscriptionLapsed(sub database.Subscription, now time.Time) bool {
+	return sub.Entitled() && sub.Current_Period_End != nil && now.After(sub.Current_Period_End.Add(subscriptionGracePeriod))
+}
+
+// expireSubscriptions periodically ends subscriptions whose paid period and
+// grace period have passed without a renewal. It never returns.
+func (cfg *apiConfig) expireSubscriptions(interval time.Duration) {
+	for range time.Tick(interval) {
+		users, err := cfg.DB.GetUsers()
+
+		if err != nil {
+			log.Printf("Could not load users: %s", err)
+			continue
+		}
+
+		now := time.Now().UTC()
+
+		for _, user := range users {
+			if !subscriptionLapsed(user.Subscription, now) {
+				continue
+			}
+
+			_, err = cfg.DB.UpdateSubscription(user.Id, func(sub *database.Subscription) error {
+				if !subscriptionLapsed(*sub, now) {
+					return nil
+				}
+
+				return applySubscriptionEvent(sub, "subscription.expired", "", nil, now)
+			})
+			cfg.audit(nil, 0, "subscription.expired", auditTarget("user", user.Id), auditOutcome(err))
+
+			if err != nil {
+				log.Printf("Could not expire subscription of user %d: %s", user.Id, err)
+			}
+		}
+	}
+}
+
+func (cfg *apiConfig) handlerGetSubscription(w http.ResponseWriter, r *http.Request) {
+	userId, err := cfg.authenticate(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	user, err := cfg.DB.GetUser(userId)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	subscription := user.Subscription
+
+	if subscription.History == nil {
+		subscription.History = []database.SubscriptionChange{}
+	}
+
+	respondWithJSON(w, http.StatusOK, SubscriptionResponse{subscription, user.Is_Chirpy_Red})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+type ThreadNode struct {
+	Chirp
+	Replies      []ThreadNode `json:"replies"`
+	More_Replies string       `json:"more_replies,omitempty"`
+}
+
+type Thread struct {
+	Ancestors      []Chirp      `json:"ancestors"`
+	More_Ancestors string       `json:"more_ancestors,omitempty"`
+	Chirp          Chirp        `json:"chirp"`
+	Replies        []ThreadNode `json:"replies"`
+	More_Replies   string       `json:"more_replies,omitempty"`
+}
+
+func (cfg *apiConfig) handlerGetReplies(w http.ResponseWriter, r *http.Request) {
+	cfg.listReferencingChirps(w, r, func(chirp database.Chirp) int {
+		return chirp.In_Reply_To
+	})
+}
+
+func (cfg *apiConfig) handlerGetQuotes(w http.ResponseWriter, r *http.Request) {
+	cfg.listReferencingChirps(w, r, func(chirp database.Chirp) int {
+		return chirp.Quote_Of
+	})
+}
+
+// listReferencingChirps responds with a page of the visible chirps whose
+// reference, as picked by reference, points at the {id} chirp.
+func (cfg *apiConfig) listReferencingChirps(w http.ResponseWriter, r *http.Request, reference func(database.Chirp) int) {
+	page, err := parsePageRequest(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	caller, parent, ok := cfg.loadVisibleChirp(w, r)
+
+	if !ok {
+		return
+	}
+
+	dbChirps, err := cfg.DB.GetChirps()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
+	}
+
+	referencing := []database.Chirp{}
+
+	for _, chirp := range dbChirps {
+		if reference(chirp) == parent.Id && caller.canSee(chirp.Author_Id) {
+			referencing = append(referencing, chirp)
+		}
+	}
+
+	chirps, err := cfg.renderChirps(caller, referencing)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
+	}
+
+	sort.Slice(chirps, func(i, j int) bool {
+		return cursorPrecedes(chirpCursor(chirps[i]), chirpCursor(chirps[j]))
+	})
+
+	chirps, next, prev := paginate(chirps, page, chirpCursor, cursorPrecedes)
+	setPageLinks(w, r, page, next, prev)
+
+	respondWithJSON(w, http.StatusOK, chirps)
+}
+
+// Threads are cut off this many replies deep and this many replies wide.
+// Cut off branches carry a more_replies link to continue from.
+const threadMaxDepth = 8
+const threadMaxReplies = 20
+const threadMaxAncestors = 50
+
+func (cfg *apiConfig) handlerGetThread(w http.ResponseWriter, r *http.Request) {
+	caller, root, ok := cfg.loadVisibleChirp(w, r)
+
+	if !ok {
+		return
+	}
+
+	dbChirps, err := cfg.DB.GetChirps()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
+	}
+
+	byId := map[int]database.Chirp{}
+	children := map[int][]database.Chirp{}
+
+	for _, chirp := range dbChirps {
+		if !caller.canSee(chirp.Author_Id) {
+			continue
+		}
+
+		byId[chirp.Id] = chirp
+
+		if chirp.In_Reply_To != 0 {
+			children[chirp.In_Reply_To] = append(children[chirp.In_Reply_To], chirp)
+		}
+	}
+
+	ancestors := []database.Chirp{}
+	seen := map[int]bool{root.Id: true}
+	moreAncestors := ""
+
+	for parentId := root.In_Reply_To; parentId != 0 && !seen[parentId]; {
+		parent, ok := byId[parentId]
+
+		if !ok {
+			break
+		}
+
+		if len(ancestors) == threadMaxAncestors {
+			moreAncestors = fmt.Sprintf("/api/chirps/%d/thread", ancestors[0].Id)
+			break
+		}
+
+		seen[parentId] = true
+		ancestors = append([]database.Chirp{parent}, ancestors...)
+		parentId = parent.In_Reply_To
+	}
+
+	tree := walkThread(children, root.Id, 1)
+	selected := append([]database.Chirp{root}, ancestors...)
+	selected = appendThreadChirps(selected, tree)
+
+	rendered, err := cfg.renderChirps(caller, selected)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirps")
+		return
+	}
+
+	renderedById := map[int]Chirp{}
+
+	for _, chirp := range rendered {
+		renderedById[chirp.Id] = chirp
+	}
+
+	thread := Thread{
+		Ancestors:      make([]Chirp, 0, len(ancestors)),
+		More_Ancestors: moreAncestors,
+		Chirp:          renderedById[root.Id],
+		Replies:        buildThreadNodes(renderedById, tree.replies),
+		More_Replies:   tree.more,
+	}
+
+	for _, ancestor := range ancestors {
+		thread.Ancestors = append(thread.Ancestors, renderedById[ancestor.Id])
+	}
+
+	respondWithJSON(w, http.StatusOK, thread)
+}
+
+type threadBranch struct {
+	chirp   database.Chirp
+	replies []threadBranch
+	more    string
+}
+
+// walkThread collects the replies below parentId, oldest first, stopping at
+// threadMaxDepth levels and threadMaxReplies replies per chirp.
+func walkThread(children map[int][]database.Chirp, parentId, depth int) threadBranch {
+	branch := threadBranch{replies: []threadBranch{}}
+	replies := children[parentId]
+
+	if len(replies) == 0 {
+		return branch
+	}
+
+	if depth > threadMaxDepth {
+		branch.more = fmt.Sprintf("/api/chirps/%d/thread", parentId)
+		return branch
+	}
+
+	sort.Slice(replies, func(i, j int) bool {
+		return cursorPrecedes(dbChirpCursor(replies[i]), dbChirpCursor(replies[j]))
+	})
+
+	if len(replies) > threadMaxReplies {
+		replies = replies[:threadMaxReplies]
+		after := encodeCursor(dbChirpCursor(replies[len(replies)-1]))
+		branch.more = fmt.Sprintf("/api/chirps/%d/replies?after=%s", parentId, after)
+	}
+
+	for _, reply := range replies {
+		child := walkThread(children, reply.Id, depth+1)
+		child.chirp = reply
+		branch.replies = append(branch.replies, child)
+	}
+
+	return branch
+}
+
+func appendThreadChirps(chirps []database.Chirp, branch threadBranch) []database.Chirp {
+	for _, reply := range branch.replies {
+		chirps = append(chirps, reply.chirp)
+		chirps = appendThreadChirps(chirps, reply)
+	}
+
+	return chirps
+}
+
+func buildThreadNodes(rendered map[int]Chirp, branches []threadBranch) []ThreadNode {
+	nodes := make([]ThreadNode, 0, len(branches))
+
+	for _, branch := range branches {
+		nodes = append(nodes, ThreadNode{
+			Chirp:        rendered[branch.chirp.Id],
+			Replies:      buildThreadNodes(rendered, branch.replies),
+			More_Replies: branch.more,
+		})
+	}
+
+	return nodes
+}
+
+// loadVisibleChirp resolves the {id} path value to a chirp the caller is
+// allowed to see, writing the error response itself when it is not.
+func (cfg *apiConfig) loadVisibleChirp(w http.ResponseWriter, r *http.Request) (viewer, database.Chirp, bool) {
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return caller, database.Chirp{}, false
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not parse Id")
+		return caller, database.Chirp{}, false
+	}
+
+	chirp, err := cfg.DB.GetChirp(id)
+
+	if errors.Is(err, database.ErrChirpNotFound) || (err == nil && !caller.canSee(chirp.Author_Id)) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return caller, database.Chirp{}, false
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve Chirp")
+		return caller, database.Chirp{}, false
+	}
+
+	return caller, chirp, true
+}
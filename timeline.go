@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+type TimelineEntry struct {
+	Chirp
+	Rechirped_By int        `json:"rechirped_by,omitempty"`
+	Rechirped_At *time.Time `json:"rechirped_at,omitempty"`
+}
+
+func timelineCursor(entry TimelineEntry) cursor {
+	if entry.Rechirped_At != nil {
+		return cursor{Id: entry.Id, Created_At: *entry.Rechirped_At}
+	}
+
+	return chirpCursor(entry.Chirp)
+}
+
+func newestFirst(a, b cursor) bool {
+	return cursorPrecedes(b, a)
+}
+
+func (cfg *apiConfig) handlerGetTimeline(w http.ResponseWriter, r *http.Request) {
+	page, err := parsePageRequest(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil || caller.Id == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	entries, err := cfg.buildTimeline(caller)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not build timeline")
+		return
+	}
+
+	entries, next, prev := paginate(entries, page, timelineCursor, newestFirst)
+	setPageLinks(w, r, page, next, prev)
+
+	respondWithJSON(w, http.StatusOK, entries)
+}
+
+// buildTimeline returns the caller's own chirps, chirps from the users they
+// follow and chirps those users rechirped, newest first. A chirp appears once,
+// at its most recent position.
+func (cfg *apiConfig) buildTimeline(caller viewer) ([]TimelineEntry, error) {
+	following, err := cfg.DB.GetFollowing(caller.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sources := map[int]bool{caller.Id: true}
+
+	for _, id := range following {
+		if caller.wantsInTimeline(id) {
+			sources[id] = true
+		}
+	}
+
+	dbChirps, err := cfg.DB.GetChirps()
+
+	if err != nil {
+		return nil, err
+	}
+
+	visible := []database.Chirp{}
+
+	for _, chirp := range dbChirps {
+		if caller.wantsInTimeline(chirp.Author_Id) {
+			visible = append(visible, chirp)
+		}
+	}
+
+	chirps, err := cfg.renderChirps(caller, visible)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rechirps, err := cfg.DB.GetRechirps()
+
+	if err != nil {
+		return nil, err
+	}
+
+	entriesById := map[int]TimelineEntry{}
+
+	for _, chirp := range chirps {
+		if sources[chirp.Author_Id] {
+			entriesById[chirp.Id] = TimelineEntry{Chirp: chirp}
+		}
+
+		for _, rechirp := range rechirps[chirp.Id] {
+			if rechirp.User_Id == caller.Id || !sources[rechirp.User_Id] {
+				continue
+			}
+
+			entry := TimelineEntry{
+				Chirp:        chirp,
+				Rechirped_By: rechirp.User_Id,
+				Rechirped_At: &rechirp.Created_At,
+			}
+
+			existing, ok := entriesById[chirp.Id]
+
+			if !ok || newestFirst(timelineCursor(entry), timelineCursor(existing)) {
+				entriesById[chirp.Id] = entry
+			}
+		}
+	}
+
+	entries := make([]TimelineEntry, 0, len(entriesById))
+
+	for _, entry := range entriesById {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return newestFirst(timelineCursor(entries[i]), timelineCursor(entries[j]))
+	})
+
+	return entries, nil
+}
@@ -5,6 +5,9 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -84,6 +87,53 @@ func (cfg *apiConfig) validateToken(tokenString string) (string, error) {
 		return "", errors.New("invalid issuer")
 	}
 
+	err = cfg.checkRevocation(userIDString, claimsStruct.IssuedAt)
+
+	if err != nil {
+		return "", err
+	}
+
 	return userIDString, nil
 
 }
+
+func (cfg *apiConfig) authenticate(r *http.Request) (int, error) {
+	authHeader := r.Header.Get("Authorization")
+
+	tokenString, found := strings.CutPrefix(authHeader, "Bearer ")
+
+	if !found || tokenString == "" {
+		return 0, errors.New("missing bearer token")
+	}
+
+	userIDString, err := cfg.validateToken(tokenString)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(userIDString)
+}
+
+// checkRevocation rejects tokens issued before the user's sessions were last
+// revoked. Issue times only have second precision, so tokens issued in the
+// same second as the revocation are rejected too.
+func (cfg *apiConfig) checkRevocation(userIDString string, issuedAt *jwt.NumericDate) error {
+	id, err := strconv.Atoi(userIDString)
+
+	if err != nil {
+		return err
+	}
+
+	user, err := cfg.DB.GetUser(id)
+
+	if err != nil {
+		return err
+	}
+
+	if issuedAt == nil || !issuedAt.Time.After(user.Tokens_Revoked_At) {
+		return errors.New("token has been revoked")
+	}
+
+	return nil
+}
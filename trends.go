@@ -0,0 +1,207 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const maxTrendWindow = 24 * time.Hour
+
+type Trend struct {
+	Hashtag        string  `json:"hashtag"`
+	Count          int     `json:"count"`
+	Previous_Count int     `json:"previous_count"`
+	Velocity       float64 `json:"velocity"`
+}
+
+type trendEvent struct {
+	hashtag  string
+	chirpId  int
+	authorId int
+	at       time.Time
+}
+
+// trendAggregator keeps the hashtag uses of recent chirps in memory so trends
+// can be computed without scanning the database. Events older than twice the
+// largest window are dropped, since they can no longer affect any window.
+type trendAggregator struct {
+	mux    *sync.Mutex
+	events []trendEvent
+}
+
+func newTrendAggregator(chirps []database.Chirp) *trendAggregator {
+	aggregator := &trendAggregator{
+		mux:    &sync.Mutex{},
+		events: []trendEvent{},
+	}
+
+	for _, chirp := range chirps {
+		aggregator.Record(chirp)
+	}
+
+	return aggregator
+}
+
+func (aggregator *trendAggregator) Record(chirp database.Chirp) {
+	aggregator.mux.Lock()
+	defer aggregator.mux.Unlock()
+
+	if time.Since(chirp.Created_At) > 2*maxTrendWindow {
+		return
+	}
+
+	seen := map[string]bool{}
+
+	for _, entity := range chirp.Entities {
+		if entity.Type != "hashtag" || seen[entity.Value] {
+			continue
+		}
+
+		seen[entity.Value] = true
+
+		aggregator.events = append(aggregator.events, trendEvent{
+			hashtag:  entity.Value,
+			chirpId:  chirp.Id,
+			authorId: chirp.Author_Id,
+			at:       chirp.Created_At,
+		})
+	}
+}
+
+func (aggregator *trendAggregator) Remove(chirpId int) {
+	aggregator.mux.Lock()
+	defer aggregator.mux.Unlock()
+
+	events := aggregator.events[:0]
+
+	for _, event := range aggregator.events {
+		if event.chirpId != chirpId {
+			events = append(events, event)
+		}
+	}
+
+	aggregator.events = events
+}
+
+// Trends ranks hashtags by velocity: uses in the window, each weighted down
+// with a half-life of a quarter of the window so the most recent uses count
+// most, divided by one more than the number of uses in the window before.
+// A tag that is suddenly popular therefore beats one that is always popular.
+func (aggregator *trendAggregator) Trends(window time.Duration, now time.Time, include func(authorId int) bool) []Trend {
+	aggregator.mux.Lock()
+	defer aggregator.mux.Unlock()
+
+	aggregator.pruneLocked(now)
+
+	halfLife := window / 4
+	trends := map[string]*Trend{}
+	weights := map[string]float64{}
+
+	for _, event := range aggregator.events {
+		age := now.Sub(event.at)
+
+		if age < 0 || age >= 2*window || !include(event.authorId) {
+			continue
+		}
+
+		trend, ok := trends[event.hashtag]
+
+		if !ok {
+			trend = &Trend{Hashtag: event.hashtag}
+			trends[event.hashtag] = trend
+		}
+
+		if age < window {
+			trend.Count++
+			weights[event.hashtag] += math.Pow(0.5, float64(age)/float64(halfLife))
+		} else {
+			trend.Previous_Count++
+		}
+	}
+
+	result := []Trend{}
+
+	for hashtag, trend := range trends {
+		if trend.Count == 0 {
+			continue
+		}
+
+		trend.Velocity = math.Round(weights[hashtag]/float64(trend.Previous_Count+1)*1000) / 1000
+		result = append(result, *trend)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Velocity != result[j].Velocity {
+			return result[i].Velocity > result[j].Velocity
+		}
+
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+
+		return result[i].Hashtag < result[j].Hashtag
+	})
+
+	return result
+}
+
+func (aggregator *trendAggregator) pruneLocked(now time.Time) {
+	events := aggregator.events[:0]
+
+	for _, event := range aggregator.events {
+		if now.Sub(event.at) < 2*maxTrendWindow {
+			events = append(events, event)
+		}
+	}
+
+	aggregator.events = events
+}
+
+func (cfg *apiConfig) handlerGetTrends(w http.ResponseWriter, r *http.Request) {
+	window := time.Hour
+
+	if windowString := r.URL.Query().Get("window"); windowString != "" {
+		parsed, err := time.ParseDuration(windowString)
+
+		if err != nil || parsed < time.Minute || parsed > maxTrendWindow {
+			respondWithError(w, http.StatusBadRequest, "window must be a duration between 1m and 24h")
+			return
+		}
+
+		window = parsed
+	}
+
+	limit := 10
+
+	if limitString := r.URL.Query().Get("limit"); limitString != "" {
+		parsed, err := strconv.Atoi(limitString)
+
+		if err != nil || parsed < 1 {
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+
+		limit = min(parsed, maxPageSize)
+	}
+
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	trends := cfg.Trends.Trends(window, time.Now().UTC(), caller.canSee)
+
+	if len(trends) > limit {
+		trends = trends[:limit]
+	}
+
+	respondWithJSON(w, http.StatusOK, trends)
+}
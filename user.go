@@ -2,17 +2,23 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
+	database "github.com/nicholasdavolt/chirpy/internal"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type UserLogin struct {
 	Id            int    `json:"id"`
 	Email         string `json:"email"`
+	Handle        string `json:"handle,omitempty"`
+	Role          string `json:"role"`
 	Is_Chirpy_Red bool   `json:"is_chirpy_red"`
 	Token         string `json:"token"`
 	Refresh_Token string `json:"refresh_token"`
@@ -21,9 +27,50 @@ type UserLogin struct {
 type User struct {
 	Id            int    `json:"id"`
 	Email         string `json:"email"`
+	Handle        string `json:"handle,omitempty"`
+	Role          string `json:"role"`
 	Is_Chirpy_Red bool   `json:"is_chirpy_red"`
 }
 
+func userFromDB(user database.User) User {
+	return User{
+		Id:            user.Id,
+		Email:         user.Email,
+		Handle:        user.Handle,
+		Role:          userRole(user),
+		Is_Chirpy_Red: user.Is_Chirpy_Red,
+	}
+}
+
+// PublicUser is how other users see an account; it leaves out the email.
+type PublicUser struct {
+	Id            int    `json:"id"`
+	Handle        string `json:"handle,omitempty"`
+	Is_Chirpy_Red bool   `json:"is_chirpy_red"`
+}
+
+func publicUserFromDB(user database.User) PublicUser {
+	return PublicUser{
+		Id:            user.Id,
+		Handle:        user.Handle,
+		Is_Chirpy_Red: user.Is_Chirpy_Red,
+	}
+}
+
+func validateHandle(handle string) error {
+	if len(handle) > maxHandleLength {
+		return errors.New("Handle is too long")
+	}
+
+	for _, r := range handle {
+		if r > unicode.MaxASCII || !isEntityRune(r) {
+			return errors.New("Handle may only contain letters, digits and underscores")
+		}
+	}
+
+	return nil
+}
+
 type ReturnToken struct {
 	Token string `json:"token"`
 }
@@ -32,6 +79,7 @@ func (cfg *apiConfig) handlerUserCreate(w http.ResponseWriter, r *http.Request)
 	type inputs struct {
 		Password string `json:"password"`
 		Email    string `json:"email"`
+		Handle   string `json:"handle"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
@@ -43,20 +91,34 @@ func (cfg *apiConfig) handlerUserCreate(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	err = validateHandle(input.Handle)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	hashPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), 7)
 
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Could not hash Password")
 	}
 
-	user, err := cfg.DB.CreateUser(input.Email, hashPassword)
+	user, err := cfg.DB.CreateUser(input.Email, input.Handle, hashPassword)
+
+	if errors.Is(err, database.ErrHandleTaken) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
 
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Could not Create User")
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, user)
+	cfg.audit(r, user.Id, "user.create", auditTarget("user", user.Id), auditSuccess)
+
+	respondWithJSON(w, http.StatusCreated, userFromDB(user))
 }
 
 func (cfg *apiConfig) handlerLoginPost(w http.ResponseWriter, r *http.Request) {
@@ -82,9 +144,7 @@ func (cfg *apiConfig) handlerLoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id := 0
-	email := ""
-	is_chirpy_red := false
+	user := database.User{}
 	expiresInSeconds := 0
 
 	for _, dbUser := range dbUsers {
@@ -92,16 +152,35 @@ func (cfg *apiConfig) handlerLoginPost(w http.ResponseWriter, r *http.Request) {
 			err = bcrypt.CompareHashAndPassword(dbUser.Password, []byte(input.Password))
 
 			if err != nil {
+				cfg.audit(r, dbUser.Id, "user.login", auditTarget("user", dbUser.Id), auditFailure)
 				respondWithError(w, http.StatusUnauthorized, "Incorrect Password")
 				return
 			}
 
-			id = dbUser.Id
-			email = dbUser.Email
-			is_chirpy_red = dbUser.Is_Chirpy_Red
+			user = dbUser
 		}
 	}
 
+	if user.Id == 0 {
+		cfg.audit(r, 0, "user.login", "", auditFailure)
+		respondWithError(w, http.StatusUnauthorized, "Incorrect Email")
+		return
+	}
+
+	if user.Is_Suspended {
+		cfg.audit(r, user.Id, "user.login", auditTarget("user", user.Id), auditDenied)
+		respondWithError(w, http.StatusForbidden, suspensionMessage(user))
+		return
+	}
+
+	if user.Must_Reset_Password {
+		cfg.audit(r, user.Id, "user.login", auditTarget("user", user.Id), auditDenied)
+		respondWithError(w, http.StatusForbidden, "Your password must be reset before you can log in")
+		return
+	}
+
+	id := user.Id
+
 	expiresInSeconds = cfg.validateExpiration(input.Expires_in_seconds)
 
 	tokenString, err := cfg.CreateToken(expiresInSeconds, id)
@@ -117,7 +196,9 @@ func (cfg *apiConfig) handlerLoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, UserLogin{id, email, is_chirpy_red, tokenString, refreshTokenString})
+	cfg.audit(r, id, "user.login", auditTarget("user", id), auditSuccess)
+
+	respondWithJSON(w, http.StatusOK, UserLogin{id, user.Email, user.Handle, userRole(user), user.Is_Chirpy_Red, tokenString, refreshTokenString})
 
 }
 
@@ -163,6 +244,10 @@ func (cfg *apiConfig) handlerTokenRefresh(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if !cfg.requireActive(w, userId) {
+		return
+	}
+
 	tokenString, err := cfg.CreateToken(cfg.DefaultExpiration, userId)
 
 	if err != nil {
@@ -181,10 +266,27 @@ func (cfg *apiConfig) handlerTokenRevoke(w http.ResponseWriter, r *http.Request)
 
 	refreshToken := splitHeader[1]
 
-	err := cfg.DB.RevokeRefreshToken(refreshToken)
+	dbTokens, err := cfg.DB.GetRefreshTokens()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retreive dbTokens")
+		return
+	}
+
+	userId := 0
+
+	for _, dbToken := range dbTokens {
+		if refreshToken == dbToken.TokenString {
+			userId = dbToken.UserId
+		}
+	}
+
+	err = cfg.DB.RevokeRefreshToken(refreshToken)
+	cfg.audit(r, userId, "token.revoke", auditTarget("user", userId), auditOutcome(err))
 
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Could not revoke Refresh Token")
+		return
 	}
 
 	respondWithJSON(w, http.StatusNoContent, "")
@@ -195,6 +297,7 @@ func (cfg *apiConfig) handlerUserPut(w http.ResponseWriter, r *http.Request) {
 	type inputs struct {
 		Password string `json:"password"`
 		Email    string `json:"email"`
+		Handle   string `json:"handle"`
 	}
 
 	authHeader := r.Header.Get("Authorization")
@@ -219,71 +322,33 @@ func (cfg *apiConfig) handlerUserPut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hashPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), 7)
+	err = validateHandle(input.Handle)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not hash Password")
-	}
-
-	user, err := cfg.DB.UpdateUser(userIDString, input.Email, hashPassword)
-
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not write edited user")
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, user)
-}
-
-func (cfg *apiConfig) handlerPolkaPost(w http.ResponseWriter, r *http.Request) {
-	type inputs struct {
-		Event string `json:"event"`
-		Data  struct {
-			User_id int `json:"user_id"`
-		} `json:"data"`
-	}
-
-	authHeader := r.Header.Get("Authorization")
-
-	key := ""
-
-	if authHeader != "" {
-		splitHeader := strings.Split(authHeader, " ")
-		key = splitHeader[1]
-	}
-
-	if key != cfg.Polka_Key {
-		respondWithError(w, http.StatusUnauthorized, "")
-		return
-	}
-
-	decoder := json.NewDecoder(r.Body)
-	input := inputs{}
-	err := decoder.Decode(&input)
+	hashPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), 7)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't decode input: %v", err))
-		return
+		respondWithError(w, http.StatusInternalServerError, "Could not hash Password")
 	}
 
-	if input.Event != "user.upgraded" {
-		respondWithJSON(w, http.StatusNoContent, "")
+	user, err := cfg.DB.UpdateUser(userIDString, input.Email, input.Handle, hashPassword)
+
+	if errors.Is(err, database.ErrHandleTaken) {
+		respondWithError(w, http.StatusConflict, err.Error())
 		return
 	}
 
-	err = cfg.DB.UpdateChirpyRed(input.Data.User_id)
+	userId, _ := strconv.Atoi(userIDString)
+	cfg.audit(r, userId, "user.update_credentials", auditTarget("user", userId), auditOutcome(err))
 
 	if err != nil {
-		if err.Error() == "user not found" {
-			respondWithError(w, http.StatusNotFound, err.Error())
-
-		} else {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-		}
-
+		respondWithError(w, http.StatusInternalServerError, "Could not write edited user")
 		return
 	}
 
-	respondWithJSON(w, http.StatusNoContent, "")
-
+	respondWithJSON(w, http.StatusOK, userFromDB(user))
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	database "github.com/nicholasdavolt/chirpy/internal"
+)
+
+const maxWebhookAttempts = 5
+
+// webhookEventLease is how long an attempt may run before the event can be
+// claimed again.
+const webhookEventLease = 5 * time.Minute
+
+var errIgnoredWebhookEvent = errors.New("event type is not handled")
+
+// processWebhookEvent claims the event if its status is one of statuses,
+// applies it and records the outcome in the inbox. Events of types we do not
+// handle are marked ignored rather than failed.
+func (cfg *apiConfig) processWebhookEvent(r *http.Request, id string, statuses ...string) (database.WebhookEvent, error) {
+	event, err := cfg.DB.ClaimWebhookEvent(id, statuses, webhookEventLease)
+
+	if err != nil {
+		return event, err
+	}
+
+	err = cfg.applyPolkaEvent(r, event)
+
+	status := "processed"
+	lastError := ""
+
+	if errors.Is(err, errIgnoredWebhookEvent) {
+		status = "ignored"
+		err = nil
+	} else if err != nil {
+		status = "failed"
+		lastError = err.Error()
+	}
+
+	event, finishErr := cfg.DB.FinishWebhookEvent(event.Id, status, lastError)
+
+	if finishErr != nil {
+		return event, finishErr
+	}
+
+	return event, err
+}
+
+// retryWebhookEvents periodically retries failed events, backing off
+// exponentially from interval, until they have been attempted
+// maxWebhookAttempts times. Events left pending, or processing past their
+// lease, by a crash are picked up too. It never returns.
+func (cfg *apiConfig) retryWebhookEvents(interval time.Duration) {
+	for range time.Tick(interval) {
+		events, err := cfg.DB.GetWebhookEvents()
+
+		if err != nil {
+			log.Printf("Could not load webhook events: %s", err)
+			continue
+		}
+
+		now := time.Now().UTC()
+
+		for _, event := range events {
+			if !webhookEventDue(event, interval, now) {
+				continue
+			}
+
+			event, err = cfg.processWebhookEvent(nil, event.Id, "pending", "failed")
+
+			if errors.Is(err, database.ErrWebhookEventBusy) {
+				continue
+			}
+
+			if err != nil {
+				log.Printf("Retry %d of webhook event %s failed: %s", event.Attempts, event.Id, err)
+			}
+		}
+	}
+}
+
+func webhookEventDue(event database.WebhookEvent, interval time.Duration, now time.Time) bool {
+	switch event.Status {
+	case "pending":
+		return now.Sub(event.Received_At) > interval
+	case "processing":
+		return event.Attempts < maxWebhookAttempts && event.Lease_Until != nil && now.After(*event.Lease_Until)
+	case "failed":
+		if event.Attempts >= maxWebhookAttempts || event.Last_Attempt_At == nil {
+			return false
+		}
+
+		backoff := interval << (event.Attempts - 1)
+
+		return now.Sub(*event.Last_Attempt_At) >= backoff
+	default:
+		return false
+	}
+}
+
+// handlerGetWebhookEvents lists inbox events, newest first, optionally
+// filtered by status and type.
+func (cfg *apiConfig) handlerGetWebhookEvents(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	eventType := r.URL.Query().Get("type")
+
+	page, err := parsePageRequest(r)
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbEvents, err := cfg.DB.GetWebhookEvents()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook events")
+		return
+	}
+
+	events := []database.WebhookEvent{}
+
+	for _, event := range dbEvents {
+		if (status == "" || event.Status == status) && (eventType == "" || event.Type == eventType) {
+			events = append(events, event)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].Received_At.Equal(events[j].Received_At) {
+			return events[i].Received_At.After(events[j].Received_At)
+		}
+
+		return events[i].Id < events[j].Id
+	})
+
+	respondWithJSON(w, http.StatusOK, paginateRanked(w, r, events, page))
+}
+
+func (cfg *apiConfig) handlerGetWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	event, err := cfg.DB.GetWebhookEvent(r.PathValue("id"))
+
+	if errors.Is(err, database.ErrWebhookEventNotFound) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook event")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, event)
+}
+
+// handlerReplayWebhookEvent applies a stored event again, for example after
+// fixing the cause of a failure. Processed events are never applied twice,
+// and events with an attempt running are left to it.
+func (cfg *apiConfig) handlerReplayWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	event, err := cfg.DB.GetWebhookEvent(r.PathValue("id"))
+
+	if errors.Is(err, database.ErrWebhookEventNotFound) {
+		respondWithError(w, http.StatusNotFound, "Could not find Id")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook event")
+		return
+	}
+
+	if event.Status == "processed" {
+		respondWithError(w, http.StatusConflict, "Webhook event was already processed")
+		return
+	}
+
+	_, err = cfg.processWebhookEvent(r, event.Id, "pending", "failed", "ignored")
+	cfg.audit(r, cfg.callerId(r), "webhook.replay", "webhook:"+event.Id, auditOutcome(err))
+
+	if errors.Is(err, database.ErrWebhookEventBusy) {
+		respondWithError(w, http.StatusConflict, "Webhook event is being processed")
+		return
+	}
+
+	event, err = cfg.DB.GetWebhookEvent(event.Id)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Could not retrieve webhook event")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, event)
+}
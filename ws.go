@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait       = 10 * time.Second
+	wsPongWait        = 60 * time.Second
+	wsPingInterval    = wsPongWait * 9 / 10
+	wsMaxMessageSize  = 4096
+	wsMaxTopics       = 50
+	wsReplyBufferSize = 16
+)
+
+// Clients authenticate with a bearer token rather than cookies, so requests
+// from other origins cannot act as the user and any origin is allowed.
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsRequest is a message from the client. Topics are "timeline",
+// "notifications", "user:<id>" and "hashtag:<tag>".
+type wsRequest struct {
+	Type   string   `json:"type"`
+	Topics []string `json:"topics"`
+}
+
+type wsMessage struct {
+	Type   string      `json:"type"`
+	Topic  string      `json:"topic,omitempty"`
+	Topics []string    `json:"topics,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// wsClient is one connection. Its topics map each topic the client asked
+// for to the hub topics it covers, as the timeline covers several users.
+type wsClient struct {
+	cfg     *apiConfig
+	conn    *websocket.Conn
+	caller  viewer
+	sub     *hubSubscription
+	mux     *sync.Mutex
+	topics  map[string][]string
+	replies chan wsMessage
+	done    chan struct{}
+}
+
+// handlerWebSocket upgrades to a WebSocket on which clients subscribe to
+// topics and receive their events. Browsers cannot set headers on the
+// upgrade request, so the token may also be given as access_token.
+func (cfg *apiConfig) handlerWebSocket(w http.ResponseWriter, r *http.Request) {
+	if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	caller, err := cfg.loadViewer(r)
+
+	if err != nil || caller.Id == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if !cfg.requireActive(w, caller.Id) {
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		return
+	}
+
+	client := &wsClient{
+		cfg:     cfg,
+		conn:    conn,
+		caller:  caller,
+		sub:     cfg.Hub.Connect(),
+		mux:     &sync.Mutex{},
+		topics:  map[string][]string{},
+		replies: make(chan wsMessage, wsReplyBufferSize),
+		done:    make(chan struct{}),
+	}
+
+	go client.readLoop()
+	client.writeLoop()
+}
+
+func (client *wsClient) readLoop() {
+	defer close(client.done)
+
+	client.conn.SetReadLimit(wsMaxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, dat, err := client.conn.ReadMessage()
+
+		if err != nil {
+			return
+		}
+
+		request := wsRequest{}
+		replies := []wsMessage{{Type: "error", Error: "Couldn't decode input"}}
+
+		if json.Unmarshal(dat, &request) == nil {
+			replies = client.handleRequest(request)
+		}
+
+		for _, reply := range replies {
+			if client.reply(reply) != nil {
+				return
+			}
+		}
+	}
+}
+
+// reply queues message for the write loop. A client that does not read its
+// replies is disconnected rather than buffered for.
+func (client *wsClient) reply(message wsMessage) error {
+	select {
+	case client.replies <- message:
+		return nil
+	default:
+		return errors.New("client is not reading replies")
+	}
+}
+
+// handleRequest applies the request and returns the replies: an error for
+// each topic that could not be subscribed to, then the client's topics.
+func (client *wsClient) handleRequest(request wsRequest) []wsMessage {
+	if len(request.Topics) == 0 {
+		return []wsMessage{{Type: "error", Error: "topics are required"}}
+	}
+
+	replies := []wsMessage{}
+
+	switch request.Type {
+	case "subscribe":
+		for _, topic := range request.Topics {
+			err := client.subscribe(topic)
+
+			if err != nil {
+				replies = append(replies, wsMessage{Type: "error", Topic: topic, Error: err.Error()})
+			}
+		}
+	case "unsubscribe":
+		for _, topic := range request.Topics {
+			client.unsubscribe(topic)
+		}
+	default:
+		return []wsMessage{{Type: "error", Error: "type must be subscribe or unsubscribe"}}
+	}
+
+	client.mux.Lock()
+	defer client.mux.Unlock()
+
+	topics := make([]string, 0, len(client.topics))
+
+	for topic := range client.topics {
+		topics = append(topics, topic)
+	}
+
+	slices.Sort(topics)
+
+	return append(replies, wsMessage{Type: "subscriptions", Topics: topics})
+}
+
+func (client *wsClient) subscribe(topic string) error {
+	hubTopics, err := client.resolveTopic(topic)
+
+	if err != nil {
+		return err
+	}
+
+	client.mux.Lock()
+	defer client.mux.Unlock()
+
+	previous, ok := client.topics[topic]
+
+	if !ok && len(client.topics) >= wsMaxTopics {
+		return fmt.Errorf("at most %d topics can be subscribed to", wsMaxTopics)
+	}
+
+	client.topics[topic] = hubTopics
+	client.cfg.Hub.Subscribe(client.sub, hubTopics...)
+	client.releaseLocked(previous)
+
+	return nil
+}
+
+func (client *wsClient) unsubscribe(topic string) {
+	client.mux.Lock()
+	defer client.mux.Unlock()
+
+	hubTopics, ok := client.topics[topic]
+
+	if !ok {
+		return
+	}
+
+	delete(client.topics, topic)
+	client.releaseLocked(hubTopics)
+}
+
+// releaseLocked unsubscribes from the hub topics no topic of the client
+// covers any more.
+func (client *wsClient) releaseLocked(hubTopics []string) {
+	unused := []string{}
+
+	for _, hubTopic := range hubTopics {
+		if len(client.subscribersOf(hubTopic)) == 0 {
+			unused = append(unused, hubTopic)
+		}
+	}
+
+	client.cfg.Hub.Unsubscribe(client.sub, unused...)
+}
+
+// subscribersOf returns the client's topics that cover hubTopic.
+func (client *wsClient) subscribersOf(hubTopic string) []string {
+	topics := []string{}
+
+	for topic, hubTopics := range client.topics {
+		if slices.Contains(hubTopics, hubTopic) {
+			topics = append(topics, topic)
+		}
+	}
+
+	return topics
+}
+
+// resolveTopic returns the hub topics a client topic covers. The timeline
+// covers the caller and the users they follow when they subscribe, so it
+// should be subscribed to again after following someone.
+func (client *wsClient) resolveTopic(topic string) ([]string, error) {
+	caller := client.caller
+
+	switch {
+	case topic == "timeline":
+		following, err := client.cfg.DB.GetFollowing(caller.Id)
+
+		if err != nil {
+			return nil, errors.New("Could not retrieve relationships")
+		}
+
+		hubTopics := []string{fmt.Sprintf("user:%d", caller.Id)}
+
+		for _, id := range following {
+			if caller.wantsInTimeline(id) {
+				hubTopics = append(hubTopics, fmt.Sprintf("user:%d", id))
+			}
+		}
+
+		return hubTopics, nil
+	case topic == "notifications":
+		return []string{fmt.Sprintf("notifications:%d", caller.Id)}, nil
+	case strings.HasPrefix(topic, "user:"):
+		id, err := strconv.Atoi(strings.TrimPrefix(topic, "user:"))
+
+		if err != nil {
+			return nil, errors.New("Could not parse Id")
+		}
+
+		if !caller.canSee(id) {
+			return nil, errors.New("Cannot subscribe to this user")
+		}
+
+		return []string{fmt.Sprintf("user:%d", id)}, nil
+	case strings.HasPrefix(topic, "hashtag:") && len(topic) > len("hashtag:"):
+		return []string{"hashtag:" + strings.ToLower(strings.TrimPrefix(topic, "hashtag:"))}, nil
+	default:
+		return nil, errors.New("topic must be timeline, notifications, user:<id> or hashtag:<tag>")
+	}
+}
+
+// writeLoop is the connection's only writer. It sends replies and hub
+// messages and pings the client, closing the connection when the client
+// stops responding or falls too far behind.
+func (client *wsClient) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+
+	defer func() {
+		ping.Stop()
+		client.cfg.Hub.Disconnect(client.sub)
+		client.conn.Close()
+	}()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case reply := <-client.replies:
+			if client.write(reply) != nil {
+				return
+			}
+		case message, ok := <-client.sub.C:
+			if !ok {
+				client.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Client fell behind"), time.Now().Add(wsWriteWait))
+				return
+			}
+
+			if message.Author_Id != 0 && !client.caller.canSee(message.Author_Id) {
+				continue
+			}
+
+			client.mux.Lock()
+			topics := client.subscribersOf(message.Topic)
+			client.mux.Unlock()
+
+			for _, topic := range topics {
+				if client.write(wsMessage{Type: message.Type, Topic: topic, Data: message.Data}) != nil {
+					return
+				}
+			}
+		case <-ping.C:
+			if client.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (client *wsClient) write(message wsMessage) error {
+	client.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+
+	return client.conn.WriteJSON(message)
+}